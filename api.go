@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// newHandler serves the blocklist file and the json api, status reports
+// the instances.
+func newHandler(file string, db *DB, status func() []InstanceStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", &blocklistFiles{file})
+
+	mux.HandleFunc("GET /api/reputation", func(w http.ResponseWriter, r *http.Request) {
+		var minScore float64
+		if v := r.URL.Query().Get("min"); v != "" {
+			var err error
+			if minScore, err = strconv.ParseFloat(v, 64); err != nil {
+				http.Error(w, "invalid min", http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp := []Reputation{}
+		err := db.rangeReputation(conf().Reputation.HalfLife, func(v Reputation) {
+			if v.Score >= minScore {
+				resp = append(resp, v)
+			}
+		})
+		if err != nil {
+			slog.Error("api reputation", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		slices.SortFunc(resp, func(a, b Reputation) int {
+			switch {
+			case a.Score > b.Score:
+				return -1
+			case a.Score < b.Score:
+				return 1
+			}
+			return 0
+		})
+
+		writeJSON(w, resp)
+	})
+
+	mux.HandleFunc("GET /api/reputation/{addr}", func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(r.PathValue("addr"))
+		if err != nil {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+
+		v, ok, err := db.reputation(conf().Reputation.HalfLife, addr.String())
+		if err != nil {
+			slog.Error("api reputation", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJSON(w, v)
+	})
+
+	mux.HandleFunc("GET /api/shadow", func(w http.ResponseWriter, r *http.Request) {
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			var err error
+			if days, err = strconv.Atoi(v); err != nil || days <= 0 {
+				http.Error(w, "invalid days", http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp, err := db.shadowMatches(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			slog.Error("api shadow", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, resp)
+	})
+
+	mux.HandleFunc("GET /api/rules", func(w http.ResponseWriter, r *http.Request) {
+		c := conf()
+		resp, err := db.ruleStats(c.detectors, c.privateDetectors)
+		if err != nil {
+			slog.Error("api rules", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, resp)
+	})
+
+	mux.HandleFunc("GET /api/instances", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, status())
+	})
+
+	// healthz fails while the circuit breaker of an instance is not closed
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		resp := status()
+
+		code := http.StatusOK
+		for _, v := range resp {
+			if !v.Health.Healthy() {
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("healthz", "err", err)
+		}
+	})
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writeJSON", "err", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	_ "embed"
 	"encoding/hex"
@@ -11,7 +12,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // from https://github.com/c0re100/qBittorrent-Enhanced-Edition/blob/v4_6_x/src/base/bittorrent/peer_blacklist.hpp
@@ -48,15 +51,22 @@ var blocklist = []string{
 	"qq",
 	// "libtorrent",
 
-	"anacrolix[ /]torrent v?([0-1]\\.(([0-9]|[0-4][0-9]|[0-5][0-2])\\.[0-9]+|(53\\.[0-2]( |$)))|unknown)",
+	// anacrolix/torrent < 1.53.3 and qBittorrent 3.3.15 are peerIDRules
 	"trafficConsume", "\u07ad__",
 	"go[ \\.]torrent",
 	"Taipei-Torrent dev",
-	"qBittorrent[ /]3\\.3\\.15",
 	"gobind", "offline-download",
 	"ljyun.cn",
 }
 
+// structured client rules of the peerid detector, see ClientRule. A
+// version that does not parse, such as a pseudo-version build, is unknown
+// and not banned by them.
+var peerIDRules = []string{
+	"anacrolix/torrent < 1.53.3",
+	"qBittorrent == 3.3.15",
+}
+
 // from https://raw.githubusercontent.com/PBH-BTN/			/main/combine/all.txt
 //
 //go:embed all.txt
@@ -89,7 +99,73 @@ var othersRules = []string{
 	"240e:918:8008::/48",
 }
 
-var ips = filter(append(strings.Split(string(pbhRule), "\n"), othersRules...))
+var (
+	rulesMu    sync.RWMutex
+	feedRule   = pbhRule
+	customRule []byte
+	ips        = filter(append(strings.Split(string(pbhRule), "\n"), othersRules...))
+	prefixes   = toPrefixes(ips)
+)
+
+// currentRules returns the merged feed, custom and built-in address rules.
+func currentRules() []string {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return ips
+}
+
+// setRules re-merges the rules and reports whether the result changed.
+// A nil argument keeps the previously loaded content.
+func setRules(feed, custom []byte) bool {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	if feed != nil {
+		feedRule = feed
+	}
+	if custom != nil {
+		customRule = custom
+	}
+
+	n := filter(append(strings.Split(string(feedRule)+"\n"+string(customRule), "\n"), conf().OthersRules...))
+	changed := !slices.Equal(n, ips)
+	ips = n
+	if changed {
+		prefixes = toPrefixes(ips)
+	}
+
+	return changed
+}
+
+// inRules reports whether addr is covered by the merged address rules.
+func inRules(addr netip.Addr) bool {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+
+	addr = addr.Unmap()
+	for _, v := range prefixes {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// toPrefixes parses the filtered rules, addresses become single address
+// prefixes.
+func toPrefixes(ips []string) []netip.Prefix {
+	resp := make([]netip.Prefix, 0, len(ips))
+	for _, v := range ips {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			resp = append(resp, p)
+			continue
+		}
+		if a, err := netip.ParseAddr(v); err == nil {
+			resp = append(resp, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return resp
+}
 
 var regexps Regexps
 
@@ -102,14 +178,20 @@ func init() {
 type Regexps []*regexp.Regexp
 
 func (r Regexps) MatchString(s ...string) bool {
+	_, ok := r.Match(s...)
+	return ok
+}
+
+// Match returns the first pattern that matches any of s.
+func (r Regexps) Match(s ...string) (string, bool) {
 	for _, v := range r {
 		for _, v2 := range s {
 			if v.MatchString(v2) {
-				return true
+				return v.String(), true
 			}
 		}
 	}
-	return false
+	return "", false
 }
 
 func filter(ips []string) []string {
@@ -131,25 +213,55 @@ func filter(ips []string) []string {
 	return ret
 }
 
-func initRule(path string) {
+func initRule(ctx context.Context, path string) {
 	b, err := os.ReadFile(filepath.Join(path, "all.txt"))
 	if err != nil {
 		slog.Error("read all.txt failed", "err", err)
-		refreshRule(path)
-		return
+		refreshRule(ctx, path)
+	}
+
+	setRules(b, readCustom(path))
+}
+
+// reloadRule reads all.txt and custom.txt from disk again, it is called
+// by the rules watcher and reports whether the merged rules changed.
+func reloadRule(path string) bool {
+	b, err := os.ReadFile(filepath.Join(path, "all.txt"))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("read all.txt failed", "err", err)
 	}
 
+	changed := setRules(b, readCustom(path))
+	if changed {
+		slog.Info("reloadRule", "ips", len(currentRules()))
+	}
+
+	return changed
+}
+
+func readCustom(path string) []byte {
 	z, err := os.ReadFile(filepath.Join(path, "custom.txt"))
 	if err != nil {
-		slog.Error("read custom.txt failed", "err", err)
+		if !os.IsNotExist(err) {
+			slog.Error("read custom.txt failed", "err", err)
+		}
+		// an empty, non nil slice drops the previous custom entries
+		return []byte{}
 	}
 
-	ips = filter(append(strings.Split(string(b)+"\n"+string(z), "\n"), othersRules...))
+	return z
 }
 
-func refreshRule(path string) {
-	resp, err := http.Get("https://raw.githubusercontent.com/PBH-BTN/BTN-Collected-Rules/main/combine/all.txt")
+func refreshRule(ctx context.Context, path string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://raw.githubusercontent.com/PBH-BTN/BTN-Collected-Rules/main/combine/all.txt", nil)
+	if err != nil {
+		slog.Error("refreshRule", "err", err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		slog.Error("refreshRule", "err", err)
 		return
 	}
 	defer resp.Body.Close()
@@ -165,14 +277,10 @@ func refreshRule(path string) {
 		return
 	}
 
-	z, err := os.ReadFile(filepath.Join(path, "custom.txt"))
-	if err != nil {
-		slog.Error("readFile", "err", err)
-	}
-	ips = filter(append(strings.Split(string(b)+"\n"+string(z), "\n"), othersRules...))
+	setRules(b, readCustom(path))
 
 	sh256 := sha256.Sum256(b)
-	slog.Info("refreshRule", "ips", len(ips), "sha256", hex.EncodeToString(sh256[:]))
+	slog.Info("refreshRule", "ips", len(currentRules()), "sha256", hex.EncodeToString(sh256[:]))
 
 	err = os.WriteFile(filepath.Join(path, "all.txt"), b, 0644)
 	if err != nil {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"net/url"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+const (
+	ClientTransmission = "transmission"
+	ClientQBittorrent  = "qbittorrent"
+	ClientDeluge       = "deluge"
+)
+
+// TorrentClient is the torrent client whose peers are scanned and banned.
+// Torrents and peers are reported in the transmission model whatever the
+// backend, fields a backend does not know are nil, and torrents are
+// addressed by their info hash.
+type TorrentClient interface {
+	// Torrents lists the torrents with their peers, Peers is nil for the
+	// torrents whose peers were not fetched
+	Torrents(ctx context.Context) ([]transmissionrpc.Torrent, error)
+	// ReloadBlocklist makes the client load the blocklist again, it returns
+	// the number of rules when the client tells
+	ReloadBlocklist(ctx context.Context) (int64, error)
+	StopTorrents(ctx context.Context, hashes []string) error
+	StartTorrents(ctx context.Context, hashes []string) error
+	// BanPeers bans the peers in the client, clients without a native ban
+	// rely on the blocklist and do nothing
+	BanPeers(ctx context.Context, peers []netip.AddrPort) error
+
+	// the policy actions besides stop
+	RemoveTorrents(ctx context.Context, hashes []string, deleteData bool) error
+	MoveTorrents(ctx context.Context, hashes []string, dir string) error
+	// LimitTorrents sets the upload limit in KB/s
+	LimitTorrents(ctx context.Context, hashes []string, limit int64) error
+}
+
+// DecoyClient is implemented by the backends that can seed honeypot decoys.
+type DecoyClient interface {
+	// AddTorrent adds a torrent whose data is complete in dir
+	AddTorrent(ctx context.Context, metainfo []byte, dir string, labels []string) error
+}
+
+// newClient connects to the backend of the instance.
+func newClient(c Instance) (TorrentClient, error) {
+	u, err := url.Parse(c.RPC)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Client {
+	case ClientTransmission:
+		if c.Username != "" {
+			u.User = url.UserPassword(c.Username, c.Password)
+		}
+		t, err := newTransmission(u)
+		if err != nil {
+			return nil, err
+		}
+		t.instance = c.Name
+		return t, nil
+	case ClientQBittorrent:
+		return newQBittorrent(u, c.Username, c.Password)
+	case ClientDeluge:
+		return newDeluge(u, c.Password)
+	}
+
+	return nil, fmt.Errorf("unknown client %q", c.Client)
+}
+
+func torrentHashes(torrents []transmissionrpc.Torrent) []string {
+	var hashes []string
+	for _, v := range torrents {
+		if v.HashString != nil {
+			hashes = append(hashes, *v.HashString)
+		}
+	}
+	return hashes
+}
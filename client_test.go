@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestQBittorrent(t *testing.T) {
+	var calls []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("password") != "secret" {
+			_, _ = w.Write([]byte("Fails."))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: "x", Path: "/"})
+		_, _ = w.Write([]byte("Ok."))
+	})
+	auth := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("SID"); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			calls = append(calls, r.URL.Path+"?"+r.URL.RawQuery+r.PostFormValue("hashes")+r.PostFormValue("peers"))
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/api/v2/torrents/info", auth(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"hash":"aa","name":"a","state":"uploading","tags":"x, y","up_limit":2048},{"hash":"bb","state":"pausedUP","private":false}]`))
+	}))
+	mux.HandleFunc("/api/v2/sync/torrentPeers", auth(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"peers":{"1.2.3.4:6881":{"ip":"1.2.3.4","port":6881,"client":"qBittorrent 4.6.2","peer_id_client":"-XL0012-","flags":"u I"}}}`))
+	}))
+	// the listing of 4.x lacks the private flag, the properties of aa tell
+	mux.HandleFunc("/api/v2/torrents/properties", auth(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"is_private":false}`))
+	}))
+	// a 4.x WebUI without the stop endpoint
+	mux.HandleFunc("/api/v2/torrents/pause", auth(func(http.ResponseWriter, *http.Request) {}))
+	mux.HandleFunc("/api/v2/transfer/banPeers", auth(func(http.ResponseWriter, *http.Request) {}))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	q, err := newQBittorrent(u, "admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ts, err := q.Torrents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 2 || *ts[0].Status != transmissionrpc.TorrentStatusSeed || *ts[1].Status != transmissionrpc.TorrentStatusStopped ||
+		*ts[0].UploadLimit != 2 || len(ts[0].Labels) != 2 || *ts[0].IsPrivate || *ts[1].IsPrivate {
+		t.Fatal(ts)
+	}
+
+	if p := ts[0].Peers; len(p) != 1 || !p[0].PeerIsInterested || p[0].IsUploadingTo || !p[0].IsIncoming || len(ts[1].Peers) != 0 {
+		t.Fatal(p)
+	}
+
+	// the peer id is compared with the name
+	if rule, _ := newSpoofDetector("spoof", 0.5).Detect(&ts[0], &ts[0].Peers[0]); rule != "name-peerid-mismatch" {
+		t.Fatal(rule)
+	}
+
+	// the flag of aa is read once
+	if _, err := q.Torrents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	props := 0
+	for _, v := range calls {
+		if v == "/api/v2/torrents/properties?hash=aa" {
+			props++
+		}
+	}
+	if props != 1 {
+		t.Fatal(calls)
+	}
+
+	if err := q.StopTorrents(ctx, []string{"aa", "bb"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.BanPeers(ctx, []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:6881")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if last := calls[len(calls)-2:]; last[0] != "/api/v2/torrents/pause?aa|bb" || last[1] != "/api/v2/transfer/banPeers?1.2.3.4:6881" {
+		t.Fatal(calls)
+	}
+
+	q, _ = newQBittorrent(u, "admin", "wrong")
+	if _, err := q.Torrents(ctx); err == nil {
+		t.Fatal("wrong password")
+	}
+}
+
+func TestDeluge(t *testing.T) {
+	var (
+		loggedIn bool
+		paused   []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			ID     int64             `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		var result any
+		switch req.Method {
+		case "auth.login":
+			loggedIn = string(req.Params[0]) == `"secret"`
+			result = loggedIn
+		case "web.connected":
+			result = true
+		case "core.get_torrents_status":
+			result = map[string]any{"aa": map[string]any{
+				"name": "a", "state": "Seeding", "progress": 100, "label": "tv",
+				"peers": []any{map[string]any{"ip": "[2001:db8::1]:6881", "client": "qBittorrent 4.6.0", "up_speed": 10}},
+			}}
+		case "core.pause_torrents":
+			_ = json.Unmarshal(req.Params[0], &paused)
+		}
+
+		resp := map[string]any{"id": req.ID, "result": result, "error": nil}
+		if !loggedIn {
+			resp = map[string]any{"id": req.ID, "result": nil, "error": map[string]any{"message": "Not authenticated", "code": 1}}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/json")
+	d, err := newDeluge(u, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ts, err := d.Torrents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 1 || *ts[0].HashString != "aa" || *ts[0].Status != transmissionrpc.TorrentStatusSeed || ts[0].Labels[0] != "tv" {
+		t.Fatal(ts)
+	}
+
+	if p := ts[0].Peers; len(p) != 1 || p[0].Address != "2001:db8::1" || p[0].Port != 6881 || !p[0].IsUploadingTo {
+		t.Fatal(p)
+	}
+
+	// the session expired
+	loggedIn = false
+	if err := d.StopTorrents(ctx, []string{"aa"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paused) != 1 || paused[0] != "aa" {
+		t.Fatal(paused)
+	}
+}
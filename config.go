@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Client is the backend of rpc: transmission, qbittorrent or deluge
+	Client   string `yaml:"client"`
+	RPC      string `yaml:"rpc"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Instances replace client, rpc, username and password to manage
+	// several clients
+	Instances []Instance `yaml:"instances,omitempty"`
+	Host      string     `yaml:"host"`
+	File      string     `yaml:"file"`
+	DB        string     `yaml:"db"`
+	Iptables  bool       `yaml:"iptables"`
+	// CleanupOnExit removes the nftables table on shutdown
+	CleanupOnExit bool `yaml:"cleanup_on_exit"`
+
+	LogLevel     string        `yaml:"log_level"`
+	ScanInterval time.Duration `yaml:"scan_interval"`
+	FeedInterval time.Duration `yaml:"feed_interval"`
+	BanExpiry    time.Duration `yaml:"ban_expiry"`
+	TableName    string        `yaml:"table_name"`
+	// ConfigureBlocklist sets the blocklist url of the clients that have
+	// none or transmission's default and enables it. BlocklistURL is
+	// derived from host and file when empty
+	ConfigureBlocklist bool   `yaml:"configure_blocklist"`
+	BlocklistURL       string `yaml:"blocklist_url"`
+	// BlocklistDir is the config dir of transmission when it runs on the
+	// same host, the blocklist is written into its blocklists dir and read
+	// from there by blocklist-update
+	BlocklistDir string `yaml:"blocklist_dir"`
+	// AlertURL receives a json post for each ban whose peer stayed
+	// connected after every escalation
+	AlertURL string `yaml:"alert_url"`
+	// Retry is how calls to the clients are retried
+	Retry       RetryConfig `yaml:"retry"`
+	OthersRules []string    `yaml:"others_rules"`
+
+	// Policies are checked in order against seeding torrents, the first
+	// matching policy is applied
+	Policies  []Policy     `yaml:"policies"`
+	Detectors DetectorSets `yaml:"detectors"`
+
+	Private    PrivateConfig    `yaml:"private"`
+	Reputation ReputationConfig `yaml:"reputation"`
+	GeoIP      GeoIPConfig      `yaml:"geoip"`
+	Honeypot   HoneypotConfig   `yaml:"honeypot"`
+
+	geo              *GeoDB
+	detectors        map[string][]Detector
+	privateDetectors map[string][]Detector
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Client:       ClientTransmission,
+		RPC:          "http://127.0.0.1:9091/transmission/rpc",
+		Host:         ":9092",
+		File:         "blocklist.txt",
+		DB:           "blocklist.db",
+		LogLevel:     "debug",
+		ScanInterval: time.Minute * 2,
+		FeedInterval: time.Hour,
+		BanExpiry:    time.Hour * 24 * 2,
+		TableName:    "transmission-auto-ban",
+		OthersRules:  othersRules,
+		Policies: []Policy{
+			{Name: "ratio", Action: PolicyActionStop, Match: PolicyMatch{MinRatio: 3}},
+			{Name: "old-small", Action: PolicyActionStop, Match: PolicyMatch{MinAge: time.Hour * 24 * 30 * 6, MaxSize: 640 * MiB}},
+			{Name: "ratio-small", Action: PolicyActionStop, Match: PolicyMatch{MinRatio: 2.2, MinAge: time.Hour * 24 * 30 * 3, MaxSize: 640 * MiB}},
+			{Name: "old", Action: PolicyActionStop, Match: PolicyMatch{MinAge: time.Hour * 24 * 30 * 12}},
+		},
+		Detectors: defaultDetectors(),
+		Private: PrivateConfig{
+			MinSeedTime: time.Hour * 72,
+			Policies: []Policy{
+				{Name: "ratio", Action: PolicyActionStop, Match: PolicyMatch{MinRatio: 3}},
+			},
+			Detectors: defaultDetectors(),
+		},
+		ConfigureBlocklist: true,
+		Retry:              defaultRetry(),
+		Reputation:         defaultReputation(),
+		Honeypot:           defaultHoneypot(),
+	}
+}
+
+var (
+	config   atomic.Pointer[Config]
+	logLevel = new(slog.LevelVar)
+)
+
+func init() {
+	c := defaultConfig()
+	if err := c.compile(); err != nil {
+		panic(err)
+	}
+	config.Store(c)
+}
+
+// conf returns the current effective configuration, it is replaced as a
+// whole on reload so callers should not keep it across runs.
+func conf() *Config { return config.Load() }
+
+var tableNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-.]{1,64}$`)
+
+func (c *Config) Validate() error {
+	var err error
+
+	if len(c.Instances) == 0 {
+		if er := c.instances()[0].Validate(); er != nil {
+			err = errors.Join(err, er)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, v := range c.Instances {
+		if er := v.Validate(); er != nil {
+			err = errors.Join(err, fmt.Errorf("instances[%d]: %w", i, er))
+		}
+		if names[v.Name] {
+			err = errors.Join(err, fmt.Errorf("instances[%d]: duplicate name %q", i, v.Name))
+		}
+		names[v.Name] = true
+	}
+
+	if len(c.Instances) > 0 && c.BlocklistDir != "" {
+		err = errors.Join(err, errors.New("blocklist_dir: set it per instance"))
+	}
+
+	if c.Host == "" {
+		err = errors.Join(err, errors.New("host: must not be empty"))
+	}
+
+	if c.File == "" {
+		err = errors.Join(err, errors.New("file: must not be empty"))
+	}
+
+	if c.DB == "" {
+		err = errors.Join(err, errors.New("db: must not be empty"))
+	}
+
+	if _, er := parseLevel(c.LogLevel); er != nil {
+		err = errors.Join(err, fmt.Errorf("log_level: %w", er))
+	}
+
+	if c.ScanInterval < time.Second*10 {
+		err = errors.Join(err, fmt.Errorf("scan_interval: %v is less than 10s", c.ScanInterval))
+	}
+
+	if c.FeedInterval < time.Minute {
+		err = errors.Join(err, fmt.Errorf("feed_interval: %v is less than 1m", c.FeedInterval))
+	}
+
+	if c.BanExpiry <= 0 {
+		err = errors.Join(err, fmt.Errorf("ban_expiry: %v must be positive", c.BanExpiry))
+	}
+
+	if !tableNameRegexp.MatchString(c.TableName) {
+		err = errors.Join(err, fmt.Errorf("table_name: invalid name %q", c.TableName))
+	}
+
+	for _, v := range []struct{ name, url string }{{"blocklist_url", c.BlocklistURL}, {"alert_url", c.AlertURL}} {
+		if v.url == "" {
+			continue
+		}
+		if u, er := url.Parse(v.url); er != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			err = errors.Join(err, fmt.Errorf("%s: %q is not an http url", v.name, v.url))
+		}
+	}
+
+	if er := c.Retry.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("retry: %w", er))
+	}
+
+	for i, v := range c.OthersRules {
+		if _, er := netip.ParsePrefix(v); er == nil {
+			continue
+		}
+		if _, er := netip.ParseAddr(v); er == nil {
+			continue
+		}
+		err = errors.Join(err, fmt.Errorf("others_rules[%d]: %q is not an address or prefix", i, v))
+	}
+
+	if er := validatePolicies(c.Policies); er != nil {
+		err = errors.Join(err, fmt.Errorf("policies%w", er))
+	}
+
+	if er := c.Detectors.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("detectors.%w", er))
+	}
+
+	if er := c.Private.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("private: %w", er))
+	}
+
+	if er := c.Reputation.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("reputation: %w", er))
+	}
+
+	if er := c.GeoIP.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("geoip: %w", er))
+	}
+
+	if er := c.Honeypot.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("honeypot: %w", er))
+	}
+
+	// decoys are seeded by the first instance
+	if first := c.instances()[0]; c.Honeypot.Count > 0 && first.Client != ClientTransmission {
+		err = errors.Join(err, fmt.Errorf("honeypot: decoys are not supported by %s", first.Client))
+	}
+
+	if len(c.GeoIP.Databases) == 0 {
+		for i, v := range c.Policies {
+			if len(v.Match.PeerASN) > 0 || len(v.Match.PeerCountry) > 0 {
+				err = errors.Join(err, fmt.Errorf("policies[%d]: peer_asn, peer_country: no geoip databases", i))
+			}
+		}
+		for i, v := range c.Private.Policies {
+			if len(v.Match.PeerASN) > 0 || len(v.Match.PeerCountry) > 0 {
+				err = errors.Join(err, fmt.Errorf("private: policies[%d]: peer_asn, peer_country: no geoip databases", i))
+			}
+		}
+		for i, x := range c.Instances {
+			for _, v := range append(slices.Clip(x.Policies), x.PrivatePolicies...) {
+				if len(v.Match.PeerASN) > 0 || len(v.Match.PeerCountry) > 0 {
+					err = errors.Join(err, fmt.Errorf("instances[%d]: policy %q: peer_asn, peer_country: no geoip databases", i, v.Name))
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+// compile builds the detectors, c must be valid.
+func (c *Config) compile() error {
+	var err error
+
+	c.geo, err = openGeoDB(c.GeoIP.Databases)
+	if err != nil {
+		return fmt.Errorf("geoip: %w", err)
+	}
+
+	c.detectors, err = c.Detectors.New()
+	if err != nil {
+		return err
+	}
+
+	c.privateDetectors, err = c.Private.Detectors.New()
+	return err
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// loadConfig merges the defaults, the config file and the flags set on the
+// command line, later ones win. extra adds the flags of a subcommand.
+func loadConfig(name string, args []string, extra ...func(fs *flag.FlagSet)) (*Config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", "config.yaml", "config file path, ignored if the default file does not exist")
+	blockfile := fs.String("file", c.File, "file path")
+	dbfile := fs.String("db", c.DB, "blocklist db path")
+	rpc := fs.String("rpc", c.RPC, "transmission rpc url")
+	lishost := fs.String("host", c.Host, "listen host")
+	iptables := fs.Bool("iptables", c.Iptables, "enable iptables")
+	for _, f := range extra {
+		f(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	data, err := os.ReadFile(*path)
+	if err != nil && (set["config"] || !os.IsNotExist(err)) {
+		return nil, err
+	}
+
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	if set["file"] {
+		c.File = *blockfile
+	}
+	if set["db"] {
+		c.DB = *dbfile
+	}
+	if set["rpc"] {
+		c.RPC = *rpc
+	}
+	if set["host"] {
+		c.Host = *lishost
+	}
+	if set["iptables"] {
+		c.Iptables = *iptables
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.compile(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// applyConfig makes c the current configuration.
+func applyConfig(c *Config) *Config {
+	old := config.Swap(c)
+
+	level, _ := parseLevel(c.LogLevel)
+	logLevel.Set(level)
+
+	setRules(nil, nil)
+
+	return old
+}
+
+// reloadConfig reads the config again with the original arguments, fields
+// that are only read at startup are reported when they changed.
+func reloadConfig() error {
+	c, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	old := applyConfig(c)
+
+	if !sameInstances(old.instances(), c.instances()) ||
+		old.Host != c.Host || old.File != c.File || old.DB != c.DB || old.Iptables != c.Iptables || old.TableName != c.TableName {
+		slog.Warn("client, rpc, username, password, instances, host, file, db, iptables and table_name changes need a restart")
+	}
+
+	return nil
+}
+
+func checkConfig(args []string) error {
+	c, err := loadConfig("check-config", args)
+	if err != nil {
+		return err
+	}
+
+	if c.Password != "" {
+		c.Password = "********"
+	}
+
+	c.Instances = slices.Clone(c.Instances)
+	for i := range c.Instances {
+		if c.Instances[i].Password != "" {
+			c.Instances[i].Password = "********"
+		}
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	defer enc.Close()
+
+	return enc.Encode(c)
+}
+
+const (
+	KiB Size = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+	TiB
+)
+
+// Size is a byte count, it reads and writes human readable sizes such as
+// 640MiB or 5GiB.
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{
+	{"TiB", TiB}, {"GiB", GiB}, {"MiB", MiB}, {"KiB", KiB},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"B", 1},
+}
+
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	for _, v := range sizeUnits {
+		if n, ok := strings.CutSuffix(s, v.suffix); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return Size(f * float64(v.size)), nil
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(n), nil
+}
+
+func (s Size) String() string {
+	for _, v := range sizeUnits[:4] {
+		if s >= v.size && s%v.size == 0 {
+			return strconv.FormatInt(int64(s/v.size), 10) + v.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
+
+func (s Size) MarshalYAML() (any, error) { return s.String(), nil }
+
+func (s *Size) UnmarshalYAML(n *yaml.Node) error {
+	x, err := ParseSize(n.Value)
+	if err != nil {
+		return err
+	}
+	*s = x
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for v, want := range map[string]Size{
+		"640MiB": 640 * MiB,
+		"5GiB":   5 * GiB,
+		"1.5GB":  1500000000,
+		"1024":   1024,
+		"10 KiB": 10 * KiB,
+		"0B":     0,
+	} {
+		s, err := ParseSize(v)
+		if err != nil || s != want {
+			t.Fatal(v, int64(s), err)
+		}
+	}
+
+	for _, v := range []string{"", "MiB", "1.5", "ten GiB"} {
+		if _, err := ParseSize(v); err == nil {
+			t.Fatal(v)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte("scan_interval: 30s\nhost: :9000\npolicies:\n  - name: r\n    action: stop\n    match:\n      min_ratio: 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig("test", []string{"-config", path, "-host", ":9093"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ScanInterval != time.Second*30 || c.Host != ":9093" || len(c.Policies) != 1 {
+		t.Fatal(c)
+	}
+
+	err = os.WriteFile(path, []byte("scan_interval: 1s\nunknown: true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfig("test", []string{"-config", path}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestRunListenFails(t *testing.T) {
+	keepRules(t)
+	old := conf()
+	t.Cleanup(func() { applyConfig(old) })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "all.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig()
+	c.RPC = "http://127.0.0.1:1/transmission/rpc"
+	c.Host = l.Addr().String()
+	c.File = filepath.Join(dir, "blocklist.txt")
+	c.DB = filepath.Join(dir, "blocklist.db")
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is taken, run stops its workers and returns
+	done := make(chan error, 1)
+	go func() { done <- run(context.Background(), c) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expect error")
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("run did not return")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// deluge is the Deluge WebUI JSON-RPC backend. Deluge has no peer ban,
+// banned peers are kept out by the blocklist plugin.
+type deluge struct {
+	url      string
+	password string
+
+	cli *http.Client
+
+	id atomic.Int64
+
+	mu       sync.Mutex
+	loggedIn bool
+}
+
+func newDeluge(u *url.URL, password string) (*deluge, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deluge{url: u.String(), password: password, cli: &http.Client{Jar: jar, Timeout: time.Minute}}, nil
+}
+
+type delugeTorrent struct {
+	Name              string       `json:"name"`
+	TotalSize         int64        `json:"total_size"`
+	State             string       `json:"state"`
+	Progress          float64      `json:"progress"`
+	Ratio             float64      `json:"ratio"`
+	TimeAdded         float64      `json:"time_added"`
+	SeedingTime       int64        `json:"seeding_time"`
+	TimeSinceTransfer int64        `json:"time_since_transfer"`
+	SavePath          string       `json:"save_path"`
+	Label             string       `json:"label"`
+	Private           bool         `json:"private"`
+	MaxUploadSpeed    float64      `json:"max_upload_speed"`
+	Trackers          []delugeURL  `json:"trackers"`
+	Peers             []delugePeer `json:"peers"`
+}
+
+type delugeURL struct {
+	URL string `json:"url"`
+}
+
+type delugePeer struct {
+	// IP is the address and port, such as 1.2.3.4:6881 or [::1]:6881
+	IP        string  `json:"ip"`
+	Client    string  `json:"client"`
+	Progress  float64 `json:"progress"`
+	DownSpeed int64   `json:"down_speed"`
+	UpSpeed   int64   `json:"up_speed"`
+}
+
+var delugeKeys = []string{
+	"name", "total_size", "state", "progress", "ratio", "time_added", "seeding_time",
+	"time_since_transfer", "save_path", "label", "private", "max_upload_speed", "trackers", "peers",
+}
+
+func (d *deluge) Torrents(ctx context.Context) ([]transmissionrpc.Torrent, error) {
+	var ts map[string]delugeTorrent
+	if err := d.call(ctx, "core.get_torrents_status", &ts, map[string]any{}, delugeKeys); err != nil {
+		return nil, err
+	}
+
+	resp := make([]transmissionrpc.Torrent, 0, len(ts))
+	for hash, v := range ts {
+		resp = append(resp, v.torrent(hash))
+	}
+	return resp, nil
+}
+
+func (v delugeTorrent) torrent(hash string) transmissionrpc.Torrent {
+	var status transmissionrpc.TorrentStatus
+	switch v.State {
+	case "Seeding":
+		status = transmissionrpc.TorrentStatusSeed
+	case "Downloading":
+		status = transmissionrpc.TorrentStatusDownload
+	case "Queued":
+		status = transmissionrpc.TorrentStatusDownloadWait
+		if v.Progress >= 100 {
+			status = transmissionrpc.TorrentStatusSeedWait
+		}
+	case "Checking":
+		status = transmissionrpc.TorrentStatusCheck
+	default:
+		// paused, error, allocating and moving
+		status = transmissionrpc.TorrentStatusStopped
+	}
+
+	size := cunits.ImportInByte(float64(v.TotalSize))
+	added := time.Unix(int64(v.TimeAdded), 0)
+	activity := time.Now().Add(-time.Duration(v.TimeSinceTransfer) * time.Second)
+	seeding := time.Duration(v.SeedingTime) * time.Second
+	limited := v.MaxUploadSpeed > 0
+	limit := int64(v.MaxUploadSpeed)
+
+	t := transmissionrpc.Torrent{
+		HashString:    &hash,
+		Name:          &v.Name,
+		Status:        &status,
+		TotalSize:     &size,
+		UploadRatio:   &v.Ratio,
+		AddedDate:     &added,
+		ActivityDate:  &activity,
+		TimeSeeding:   &seeding,
+		DownloadDir:   &v.SavePath,
+		UploadLimited: &limited,
+		UploadLimit:   &limit,
+		IsPrivate:     &v.Private,
+	}
+
+	if v.Label != "" {
+		t.Labels = []string{v.Label}
+	}
+
+	for _, tr := range v.Trackers {
+		t.Trackers = append(t.Trackers, transmissionrpc.Tracker{Announce: tr.URL})
+	}
+
+	t.Peers = make([]transmissionrpc.Peer, 0, len(v.Peers))
+	for _, p := range v.Peers {
+		addr, err := netip.ParseAddrPort(p.IP)
+		if err != nil {
+			continue
+		}
+
+		t.Peers = append(t.Peers, transmissionrpc.Peer{
+			Address:           addr.Addr().String(),
+			Port:              int64(addr.Port()),
+			ClientName:        p.Client,
+			Progress:          p.Progress,
+			RateToClient:      p.DownSpeed,
+			RateToPeer:        p.UpSpeed,
+			IsDownloadingFrom: p.DownSpeed > 0,
+			IsUploadingTo:     p.UpSpeed > 0,
+		})
+	}
+
+	return t
+}
+
+// ReloadBlocklist forces an import of the blocklist plugin.
+func (d *deluge) ReloadBlocklist(ctx context.Context) (int64, error) {
+	return 0, d.call(ctx, "blocklist.check_import", nil, true)
+}
+
+func (d *deluge) StopTorrents(ctx context.Context, hashes []string) error {
+	return d.call(ctx, "core.pause_torrents", nil, hashes)
+}
+
+func (d *deluge) StartTorrents(ctx context.Context, hashes []string) error {
+	return d.call(ctx, "core.resume_torrents", nil, hashes)
+}
+
+func (d *deluge) BanPeers(context.Context, []netip.AddrPort) error { return nil }
+
+func (d *deluge) RemoveTorrents(ctx context.Context, hashes []string, deleteData bool) error {
+	return d.call(ctx, "core.remove_torrents", nil, hashes, deleteData)
+}
+
+func (d *deluge) MoveTorrents(ctx context.Context, hashes []string, dir string) error {
+	return d.call(ctx, "core.move_storage", nil, hashes, dir)
+}
+
+func (d *deluge) LimitTorrents(ctx context.Context, hashes []string, limit int64) error {
+	return d.call(ctx, "core.set_torrent_options", nil, hashes, map[string]any{"max_upload_speed": limit})
+}
+
+type delugeError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *delugeError) Error() string { return fmt.Sprintf("deluge: %s (%d)", e.Message, e.Code) }
+
+// call logs in and connects the WebUI to its first daemon on the first call,
+// and again when the session expired.
+func (d *deluge) call(ctx context.Context, method string, result any, params ...any) error {
+	if err := d.login(ctx, false); err != nil {
+		return err
+	}
+
+	err := d.rpc(ctx, method, result, params...)
+	if e := (*delugeError)(nil); errors.As(err, &e) && e.Code == 1 {
+		// code 1 is "Not authenticated"
+		if err := d.login(ctx, true); err != nil {
+			return err
+		}
+		err = d.rpc(ctx, method, result, params...)
+	}
+
+	return err
+}
+
+func (d *deluge) login(ctx context.Context, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.loggedIn && !force {
+		return nil
+	}
+
+	var ok bool
+	if err := d.rpc(ctx, "auth.login", &ok, d.password); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("deluge login: wrong password")
+	}
+
+	var connected bool
+	if err := d.rpc(ctx, "web.connected", &connected); err != nil {
+		return err
+	}
+
+	if !connected {
+		var hosts [][]any
+		if err := d.rpc(ctx, "web.get_hosts", &hosts); err != nil {
+			return err
+		}
+		if len(hosts) == 0 || len(hosts[0]) == 0 {
+			return fmt.Errorf("deluge: no daemon configured in the WebUI")
+		}
+		if err := d.rpc(ctx, "web.connect", nil, hosts[0][0]); err != nil {
+			return err
+		}
+	}
+
+	d.loggedIn = true
+	return nil
+}
+
+func (d *deluge) rpc(ctx context.Context, method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+
+	body, err := json.Marshal(map[string]any{"method": method, "params": params, "id": d.id.Add(1)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deluge %s: %s", method, resp.Status)
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *delugeError    `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("deluge %s: %w", method, err)
+	}
+
+	if r.Error != nil {
+		return r.Error
+	}
+
+	if result == nil || len(r.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+const (
+	DetectorTypeClient  = "client"
+	DetectorTypeChoke   = "choke"
+	DetectorTypeCorrupt = "corrupt"
+	DetectorTypeFeed    = "feed"
+	DetectorTypePeerID  = "peerid"
+	DetectorTypeSpoof   = "spoof"
+	DetectorTypeUpload  = "upload"
+)
+
+// status groups of the scanned torrents, each one has its own detectors
+const (
+	StatusSeed     = "seed"
+	StatusDownload = "download"
+	StatusQueued   = "queued"
+	StatusVerify   = "verify"
+)
+
+func statusGroup(v transmissionrpc.Torrent) string {
+	if v.Status == nil {
+		return ""
+	}
+
+	switch *v.Status {
+	case transmissionrpc.TorrentStatusSeed:
+		return StatusSeed
+	case transmissionrpc.TorrentStatusDownload:
+		return StatusDownload
+	case transmissionrpc.TorrentStatusDownloadWait, transmissionrpc.TorrentStatusSeedWait:
+		return StatusQueued
+	case transmissionrpc.TorrentStatusCheckWait, transmissionrpc.TorrentStatusCheck:
+		return StatusVerify
+	}
+
+	return ""
+}
+
+// DetectorSets are the detectors for each status group.
+type DetectorSets struct {
+	Seed     []DetectorConfig `yaml:"seed"`
+	Download []DetectorConfig `yaml:"download"`
+	Queued   []DetectorConfig `yaml:"queued"`
+	Verify   []DetectorConfig `yaml:"verify"`
+}
+
+func (d DetectorSets) Validate() error {
+	var err error
+
+	for group, v := range d.groups() {
+		if er := validateDetectors(v); er != nil {
+			err = errors.Join(err, fmt.Errorf("%s%w", group, er))
+		}
+	}
+
+	return err
+}
+
+func (d DetectorSets) groups() map[string][]DetectorConfig {
+	return map[string][]DetectorConfig{
+		StatusSeed:     d.Seed,
+		StatusDownload: d.Download,
+		StatusQueued:   d.Queued,
+		StatusVerify:   d.Verify,
+	}
+}
+
+// New builds the detectors of every status group.
+func (d DetectorSets) New() (map[string][]Detector, error) {
+	resp := map[string][]Detector{}
+
+	for group, v := range d.groups() {
+		ds, err := newDetectors(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", group, err)
+		}
+		resp[group] = ds
+	}
+
+	return resp, nil
+}
+
+func defaultDetectors() DetectorSets {
+	client := DetectorConfig{Name: "client", Type: DetectorTypeClient}
+	peerid := DetectorConfig{Name: "peerid", Type: DetectorTypePeerID}
+	spoof := DetectorConfig{Name: "spoof", Type: DetectorTypeSpoof, Ratio: 0.5, Score: 50}
+	upload := DetectorConfig{
+		Name: "upload", Type: DetectorTypeUpload, Ratio: 1.5, PrefixRatio: 4,
+		MaxUpload: 100 * GiB, MaxPrefixUpload: 300 * GiB, Duration: time.Hour * 24 * 7,
+	}
+	feed := DetectorConfig{Name: "feed", Type: DetectorTypeFeed, Score: 30}
+
+	return DetectorSets{
+		Seed: []DetectorConfig{client, peerid, spoof, upload, feed},
+		Download: []DetectorConfig{
+			client,
+			peerid,
+			spoof,
+			upload,
+			feed,
+			{Name: "choke", Type: DetectorTypeChoke, Duration: time.Minute * 30, Score: 50},
+			{Name: "corrupt", Type: DetectorTypeCorrupt, Threshold: 3},
+		},
+		Queued: []DetectorConfig{client, peerid},
+		Verify: []DetectorConfig{client, peerid},
+	}
+}
+
+// Detector decides whether a peer of a torrent should be banned.
+type Detector interface {
+	Name() string
+	// Detect returns the rule that matched the peer
+	Detect(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool)
+}
+
+type DetectorConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Patterns are the client name regexps of the client detector, the
+	// built-in blocklist is used when empty
+	Patterns []string `yaml:"patterns,omitempty"`
+	// Rules are the structured client rules of the peerid detector, such as
+	// "anacrolix/torrent < 1.53.3", the built-in peerIDRules are used when
+	// empty
+	Rules []string `yaml:"rules,omitempty"`
+	// Duration is how long the choke detector waits for an unchoke, and
+	// how long the upload detector keeps idle counters
+	Duration time.Duration `yaml:"duration,omitempty"`
+	// Threshold is the number of strikes of the corrupt detector
+	Threshold int `yaml:"threshold,omitempty"`
+	// Ratio is the part of the torrent size the spoof detector uploads to a
+	// mainstream client before it must report progress, and the part one
+	// address may take for the upload detector
+	Ratio float64 `yaml:"ratio,omitempty"`
+	// PrefixRatio is the part of the torrent size one /24 or /56 may take
+	// for the upload detector
+	PrefixRatio float64 `yaml:"prefix_ratio,omitempty"`
+	// MaxUpload and MaxPrefixUpload are the bytes one address or one /24
+	// or /56 may take across all torrents for the upload detector, 0 has
+	// no limit
+	MaxUpload       Size `yaml:"max_upload,omitempty"`
+	MaxPrefixUpload Size `yaml:"max_prefix_upload,omitempty"`
+	// Score is added to the reputation of the address on a match, 0 bans
+	// at once
+	Score float64 `yaml:"score,omitempty"`
+	// Shadow detectors record their matches but never ban
+	Shadow bool `yaml:"shadow,omitempty"`
+	// ShadowRules are the rules whose matches are recorded but never
+	// banned. Client patterns and peerid rules listed here are matched in
+	// a pass of their own, so a peer caught by a live rule still records
+	// them, and must not repeat a live rule. Other detectors take rule
+	// names such as "no-progress".
+	ShadowRules []string `yaml:"shadow_rules,omitempty"`
+}
+
+func (d DetectorConfig) Validate() error {
+	var err error
+
+	if d.Name == "" {
+		err = errors.Join(err, errors.New("name: must not be empty"))
+	}
+
+	if d.Score < 0 {
+		err = errors.Join(err, errors.New("score: negative value"))
+	}
+
+	switch d.Type {
+	case DetectorTypeClient:
+		for i, v := range d.Patterns {
+			if _, er := regexp.Compile(v); er != nil {
+				err = errors.Join(err, fmt.Errorf("patterns[%d]: %w", i, er))
+			}
+		}
+		live := d.Patterns
+		if len(live) == 0 {
+			live = blocklist
+		}
+		for i, v := range d.ShadowRules {
+			if _, er := regexp.Compile(v); er != nil {
+				err = errors.Join(err, fmt.Errorf("shadow_rules[%d]: %w", i, er))
+			} else if slices.Contains(live, v) {
+				err = errors.Join(err, fmt.Errorf("shadow_rules[%d]: %q duplicates a live pattern", i, v))
+			}
+		}
+	case DetectorTypePeerID:
+		for i, v := range d.Rules {
+			if _, er := ParseClientRule(v); er != nil {
+				err = errors.Join(err, fmt.Errorf("rules[%d]: %w", i, er))
+			}
+		}
+		live := map[string]bool{}
+		rules := d.Rules
+		if len(rules) == 0 {
+			rules = peerIDRules
+		}
+		for _, v := range rules {
+			if r, er := ParseClientRule(v); er == nil {
+				live[r.String()] = true
+			}
+		}
+		for i, v := range d.ShadowRules {
+			if r, er := ParseClientRule(v); er != nil {
+				err = errors.Join(err, fmt.Errorf("shadow_rules[%d]: %w", i, er))
+			} else if live[r.String()] {
+				err = errors.Join(err, fmt.Errorf("shadow_rules[%d]: %q duplicates a live rule", i, v))
+			}
+		}
+	case DetectorTypeSpoof:
+		if d.Ratio <= 0 {
+			err = errors.Join(err, errors.New("ratio: must be positive"))
+		}
+	case DetectorTypeUpload:
+		if d.Ratio < 1 || d.PrefixRatio < 1 {
+			err = errors.Join(err, errors.New("ratio, prefix_ratio: must be at least 1"))
+		}
+		if d.MaxUpload < 0 || d.MaxPrefixUpload < 0 {
+			err = errors.Join(err, errors.New("max_upload, max_prefix_upload: negative value"))
+		}
+		if d.Duration < time.Hour {
+			err = errors.Join(err, fmt.Errorf("duration: %v is less than 1h", d.Duration))
+		}
+	case DetectorTypeChoke:
+		if d.Duration < time.Minute {
+			err = errors.Join(err, fmt.Errorf("duration: %v is less than 1m", d.Duration))
+		}
+	case DetectorTypeCorrupt:
+		if d.Threshold <= 0 {
+			err = errors.Join(err, errors.New("threshold: must be positive"))
+		}
+	case DetectorTypeFeed:
+	default:
+		err = errors.Join(err, fmt.Errorf("type: unknown detector %q", d.Type))
+	}
+
+	return err
+}
+
+func (d DetectorConfig) New() (Detector, error) {
+	switch d.Type {
+	case DetectorTypeClient:
+		rs := slices.Clone(regexps)
+		if len(d.Patterns) > 0 {
+			rs = nil
+		}
+
+		for _, v := range d.Patterns {
+			r, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			rs = append(rs, r)
+		}
+
+		var shadow Regexps
+		for _, v := range d.ShadowRules {
+			r, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			shadow = append(shadow, r)
+		}
+		return &clientDetector{d.Name, rs, shadow}, nil
+	case DetectorTypePeerID:
+		rules := d.Rules
+		if len(rules) == 0 {
+			rules = peerIDRules
+		}
+
+		var rs, shadow []ClientRule
+		for _, v := range rules {
+			r, err := ParseClientRule(v)
+			if err != nil {
+				return nil, err
+			}
+			rs = append(rs, r)
+		}
+		for _, v := range d.ShadowRules {
+			r, err := ParseClientRule(v)
+			if err != nil {
+				return nil, err
+			}
+			shadow = append(shadow, r)
+		}
+		return &peerIDDetector{d.Name, rs, shadow}, nil
+	case DetectorTypeSpoof:
+		return newSpoofDetector(d.Name, d.Ratio), nil
+	case DetectorTypeUpload:
+		return newUploadDetector(d.Name, d.Ratio, d.PrefixRatio, d.MaxUpload, d.MaxPrefixUpload, d.Duration), nil
+	case DetectorTypeChoke:
+		return newChokeDetector(d.Name, d.Duration), nil
+	case DetectorTypeCorrupt:
+		return newCorruptDetector(d.Name, d.Threshold), nil
+	case DetectorTypeFeed:
+		return &feedDetector{d.Name}, nil
+	}
+
+	return nil, fmt.Errorf("unknown detector %q", d.Type)
+}
+
+func validateDetectors(ds []DetectorConfig) error {
+	var err error
+
+	names := map[string]bool{}
+	for i, v := range ds {
+		if er := v.Validate(); er != nil {
+			err = errors.Join(err, fmt.Errorf("[%d]: %w", i, er))
+		}
+		if names[v.Name] {
+			err = errors.Join(err, fmt.Errorf("[%d]: duplicate name %q", i, v.Name))
+		}
+		names[v.Name] = true
+	}
+
+	return err
+}
+
+func newDetectors(ds []DetectorConfig) ([]Detector, error) {
+	var resp []Detector
+	for _, v := range ds {
+		d, err := v.New()
+		if err != nil {
+			return nil, fmt.Errorf("detector %s: %w", v.Name, err)
+		}
+		cd := &configuredDetector{Detector: d, score: v.Score, shadow: v.Shadow, shadowRules: map[string]bool{}}
+		if _, ok := d.(shadowDetector); !ok {
+			for _, r := range v.ShadowRules {
+				cd.shadowRules[r] = true
+			}
+		}
+		resp = append(resp, cd)
+	}
+	return resp, nil
+}
+
+// configuredDetector carries the reputation score and the shadow rules of a
+// configured detector.
+type configuredDetector struct {
+	Detector
+	score       float64
+	shadow      bool
+	shadowRules map[string]bool
+}
+
+// shadowDetector is implemented by the detectors that match their shadow
+// rules themselves, in a pass apart from the live rules.
+type shadowDetector interface {
+	DetectShadow(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool)
+}
+
+// cycleDetector is implemented by detectors that keep state between runs,
+// Cycle is called after every run to drop the state of peers that are gone.
+type cycleDetector interface {
+	Cycle()
+}
+
+func cycleDetectors(sets ...map[string][]Detector) {
+	for _, set := range sets {
+		for _, ds := range set {
+			for _, d := range ds {
+				if s, ok := d.(*configuredDetector); ok {
+					d = s.Detector
+				}
+				if c, ok := d.(cycleDetector); ok {
+					c.Cycle()
+				}
+			}
+		}
+	}
+}
+
+// Hit is a detector match of a peer.
+type Hit struct {
+	Detector string
+	Rule     string
+	// Score is the configured score, 0 bans at once
+	Score float64
+	// Shadow matches are recorded but never banned
+	Shadow bool
+}
+
+// detectAll runs every detector so the weak signals of a peer add up, it
+// also keeps the sampling of the stateful detectors regular.
+func detectAll(ds []Detector, t *transmissionrpc.Torrent, p *transmissionrpc.Peer) []Hit {
+	var resp []Hit
+	for _, d := range ds {
+		inner, c := d, &configuredDetector{}
+		if s, ok := d.(*configuredDetector); ok {
+			inner, c = s.Detector, s
+		}
+
+		if rule, ok := d.Detect(t, p); ok {
+			resp = append(resp, Hit{Detector: d.Name(), Rule: rule, Score: c.score, Shadow: c.shadow || c.shadowRules[rule]})
+		}
+
+		if s, ok := inner.(shadowDetector); ok {
+			if rule, ok := s.DetectShadow(t, p); ok {
+				resp = append(resp, Hit{Detector: d.Name(), Rule: rule, Score: c.score, Shadow: true})
+			}
+		}
+	}
+	return resp
+}
+
+// clientDetector matches the client name against regexps, and apart
+// against the shadow ones.
+type clientDetector struct {
+	name    string
+	regexps Regexps
+	shadow  Regexps
+}
+
+func (c *clientDetector) Name() string { return c.name }
+
+func (c *clientDetector) Rules() []string {
+	var resp []string
+	for _, v := range append(slices.Clone(c.regexps), c.shadow...) {
+		resp = append(resp, v.String())
+	}
+	return resp
+}
+
+func (c *clientDetector) Detect(_ *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	return c.regexps.Match(p.ClientName, strings.ToLower(p.ClientName))
+}
+
+func (c *clientDetector) DetectShadow(_ *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	return c.shadow.Match(p.ClientName, strings.ToLower(p.ClientName))
+}
+
+// peerIDDetector decodes the client name and matches it against structured
+// client rules.
+type peerIDDetector struct {
+	name   string
+	rules  []ClientRule
+	shadow []ClientRule
+}
+
+func (c *peerIDDetector) Name() string { return c.name }
+
+func (c *peerIDDetector) Rules() []string {
+	var resp []string
+	for _, v := range append(slices.Clone(c.rules), c.shadow...) {
+		resp = append(resp, v.String())
+	}
+	return resp
+}
+
+func (c *peerIDDetector) Detect(_ *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	return matchClientRules(c.rules, DecodeClient(p.ClientName))
+}
+
+func (c *peerIDDetector) DetectShadow(_ *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	return matchClientRules(c.shadow, DecodeClient(p.ClientName))
+}
+
+// matchClientRules returns the first rule that matches id.
+func matchClientRules(rules []ClientRule, id PeerID) (string, bool) {
+	for _, r := range rules {
+		if r.Match(id) {
+			return r.String(), true
+		}
+	}
+	return "", false
+}
+
+// feedDetector flags peers covered by the feed, custom and built-in address
+// rules, they are blocked already but a hit still tells about the peer.
+type feedDetector struct {
+	name string
+}
+
+func (f *feedDetector) Name() string { return f.name }
+
+func (f *feedDetector) Detect(_ *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	addr, err := netip.ParseAddr(p.Address)
+	if err != nil {
+		return "", false
+	}
+	return "feed", inRules(addr)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// chokeDetector flags peers that take data from us but keep us choked while
+// we are interested in them, for at least duration.
+type chokeDetector struct {
+	name     string
+	duration time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*chokeState
+}
+
+type chokeState struct {
+	since    time.Time
+	uploaded bool
+	seen     bool
+}
+
+func newChokeDetector(name string, duration time.Duration) *chokeDetector {
+	return &chokeDetector{name: name, duration: duration, peers: map[string]*chokeState{}}
+}
+
+func (c *chokeDetector) Name() string { return c.name }
+
+func (c *chokeDetector) Detect(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := deref(t.HashString) + "/" + p.Address
+
+	if !p.ClientIsInterested || !p.ClientIsChoked {
+		delete(c.peers, key)
+		return "", false
+	}
+
+	s, ok := c.peers[key]
+	if !ok {
+		s = &chokeState{since: time.Now()}
+		c.peers[key] = s
+	}
+
+	s.seen = true
+	if p.IsUploadingTo || p.RateToPeer > 0 {
+		s.uploaded = true
+	}
+
+	if s.uploaded && time.Since(s.since) >= c.duration {
+		return "never-unchoke", true
+	}
+
+	return "", false
+}
+
+func (c *chokeDetector) Cycle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range c.peers {
+		if !v.seen {
+			delete(c.peers, k)
+			continue
+		}
+		v.seen = false
+	}
+}
+
+// corruptDetector blames the peers that were sending to us when the corrupt
+// counter of a torrent grew. Transmission does not tell which peer sent the
+// bad piece, so each sender gets a strike, a single sender gets threshold
+// strikes at once.
+type corruptDetector struct {
+	name      string
+	threshold int
+
+	mu      sync.Mutex
+	corrupt map[string]int64
+	strikes map[string]*corruptStrike
+}
+
+type corruptStrike struct {
+	count    int
+	lastSeen time.Time
+}
+
+func newCorruptDetector(name string, threshold int) *corruptDetector {
+	return &corruptDetector{
+		name:      name,
+		threshold: threshold,
+		corrupt:   map[string]int64{},
+		strikes:   map[string]*corruptStrike{},
+	}
+}
+
+func (c *corruptDetector) Name() string { return c.name }
+
+func (c *corruptDetector) Detect(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hash, now := deref(t.HashString), deref(t.CorruptEver)
+
+	last, ok := c.corrupt[hash]
+	c.corrupt[hash] = now
+
+	if ok && now > last {
+		var senders []string
+		for _, v := range t.Peers {
+			if v.IsDownloadingFrom || v.RateToClient > 0 {
+				senders = append(senders, v.Address)
+			}
+		}
+
+		weight := 1
+		if len(senders) == 1 {
+			weight = c.threshold
+		}
+
+		for _, v := range senders {
+			s, ok := c.strikes[v]
+			if !ok {
+				s = &corruptStrike{}
+				c.strikes[v] = s
+			}
+			s.count += weight
+			s.lastSeen = time.Now()
+		}
+	}
+
+	if s, ok := c.strikes[p.Address]; ok && s.count >= c.threshold {
+		return "corrupt-data", true
+	}
+
+	return "", false
+}
+
+func (c *corruptDetector) Cycle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range c.strikes {
+		if time.Since(v.lastSeen) > time.Hour*24 {
+			delete(c.strikes, k)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestChokeDetector(t *testing.T) {
+	hash := "abc"
+	torrent := &transmissionrpc.Torrent{HashString: &hash}
+	peer := &transmissionrpc.Peer{Address: "203.0.113.1", ClientIsInterested: true, ClientIsChoked: true, RateToPeer: 1024}
+
+	d := newChokeDetector("choke", time.Minute)
+
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected at first sight")
+	}
+
+	d.peers[hash+"/"+peer.Address].since = time.Now().Add(-time.Minute * 2)
+	d.Cycle()
+
+	if _, ok := d.Detect(torrent, peer); !ok {
+		t.Fatal("not detected")
+	}
+
+	peer.ClientIsChoked = false
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected after unchoke")
+	}
+}
+
+func TestCorruptDetector(t *testing.T) {
+	hash := "abc"
+	corrupt := int64(0)
+	torrent := &transmissionrpc.Torrent{HashString: &hash, CorruptEver: &corrupt, Peers: []transmissionrpc.Peer{
+		{Address: "203.0.113.1", IsDownloadingFrom: true},
+		{Address: "203.0.113.2", RateToClient: 10},
+		{Address: "203.0.113.3"},
+	}}
+
+	d := newCorruptDetector("corrupt", 2)
+
+	for i := range 3 {
+		corrupt += 1024
+		for _, p := range torrent.Peers {
+			_, ok := d.Detect(torrent, &p)
+			want := i >= 2 && p.Address != "203.0.113.3"
+			if ok != want {
+				t.Fatal(i, p.Address, ok)
+			}
+		}
+	}
+}
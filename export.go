@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportName names the sets, tables and lists of the exported scripts.
+const exportName = "tban"
+
+// exportList is the ban set of a run as rendered by the export formats,
+// ranges are the bans and the rules merged.
+type exportList struct {
+	generated time.Time
+	bans      []entry
+	rules     []string
+	ranges    []*Range
+}
+
+func newExportList(bans []entry, rules []string, at time.Time) *exportList {
+	addrs := make([]string, 0, len(bans)+len(rules))
+	for _, v := range bans {
+		addrs = append(addrs, v.addr)
+	}
+	addrs = append(addrs, rules...)
+
+	l := &exportList{generated: at, bans: bans, rules: rules}
+	for _, v := range Merge(addrs) {
+		l.ranges = append(l.ranges, v.ToRange())
+	}
+	return l
+}
+
+// cidrs returns the ranges of one family as prefixes.
+func (l *exportList) cidrs(v6 bool) []*net.IPNet {
+	var resp []*net.IPNet
+	for _, r := range l.ranges {
+		if (r.familyLength() == net.IPv6len) == v6 {
+			resp = append(resp, r.ToIpNets()...)
+		}
+	}
+	return resp
+}
+
+// exportFormat is a rendering of the ban set, served at /export/<name>
+// and gzipped at /export/<name>.gz.
+type exportFormat struct {
+	name   string
+	ctype  string
+	render func(w io.Writer, l *exportList) error
+	// entry reports whether a line of the rendering is an entry, nil when
+	// the rendering is not line based
+	entry func(line []byte) bool
+}
+
+var exportFormats = []exportFormat{
+	{"emule.dat", "text/plain; charset=utf-8", renderEmule, everyLine},
+	{"cidr4.txt", "text/plain; charset=utf-8", renderCIDR(false), everyLine},
+	{"cidr6.txt", "text/plain; charset=utf-8", renderCIDR(true), everyLine},
+	{"blocklist.json", "application/json", renderJSON, nil},
+	{"qbittorrent.dat", "text/plain; charset=utf-8", renderQBittorrent, everyLine},
+	{"blocklist.nft", "text/plain; charset=utf-8", renderNft, linePrefix("\t\t\t")},
+	{"ipset.txt", "text/plain; charset=utf-8", renderIpset, linePrefix("add ")},
+	{"mikrotik.rsc", "text/plain; charset=utf-8", renderMikrotik, linePrefix("add ")},
+}
+
+func everyLine([]byte) bool { return true }
+
+func linePrefix(prefix string) func(line []byte) bool {
+	return func(line []byte) bool { return bytes.HasPrefix(line, []byte(prefix)) }
+}
+
+func lookupExport(name string) (exportFormat, bool) {
+	for _, v := range exportFormats {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return exportFormat{}, false
+}
+
+// exportPath is the file of an export format, in the export dir next to
+// the blocklist file.
+func exportPath(file, name string) string {
+	return filepath.Join(filepath.Dir(file), "export", name)
+}
+
+// writeExports writes every format with its gzip next to file.
+func writeExports(file string, l *exportList) error {
+	if err := os.MkdirAll(exportPath(file, ""), 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, f := range exportFormats {
+		buf.Reset()
+		if err := f.render(&buf, l); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		if err := writeBlocklist(exportPath(file, f.name), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderEmule writes the eMule ipfilter.dat, IPv4 only with zero padded
+// addresses, level 0 blocks.
+func renderEmule(w io.Writer, l *exportList) error {
+	pad := func(ip net.IP) string {
+		return fmt.Sprintf("%03d.%03d.%03d.%03d", ip[0], ip[1], ip[2], ip[3])
+	}
+
+	for _, r := range l.ranges {
+		if r.familyLength() != net.IPv4len {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s - %s , 000 , %s\n", pad(r.start), pad(r.end), exportName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderQBittorrent writes the DAT filter of qBittorrent, which reads IPv6
+// ranges as well.
+func renderQBittorrent(w io.Writer, l *exportList) error {
+	for _, r := range l.ranges {
+		if _, err := fmt.Fprintf(w, "%s - %s , 000 , %s\n", ipToString(r.start), ipToString(r.end), exportName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderCIDR(v6 bool) func(w io.Writer, l *exportList) error {
+	return func(w io.Writer, l *exportList) error {
+		for _, v := range l.cidrs(v6) {
+			if _, err := fmt.Fprintln(w, v.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type exportBan struct {
+	Addr   string    `json:"addr"`
+	Client string    `json:"client"`
+	Banned time.Time `json:"banned"`
+	Geo
+}
+
+// renderJSON writes the bans with their client, time and geo, the rules,
+// and the merged ranges.
+func renderJSON(w io.Writer, l *exportList) error {
+	bans := make([]exportBan, 0, len(l.bans))
+	for _, v := range l.bans {
+		bans = append(bans, exportBan{Addr: v.addr, Client: v.client, Banned: time.Unix(int64(v.time), 0).UTC(), Geo: v.geo})
+	}
+
+	ranges := make([]string, 0, len(l.ranges))
+	for _, v := range l.ranges {
+		ranges = append(ranges, v.String())
+	}
+
+	rules := l.rules
+	if rules == nil {
+		rules = []string{}
+	}
+
+	return json.NewEncoder(w).Encode(struct {
+		Generated time.Time   `json:"generated"`
+		Bans      []exportBan `json:"bans"`
+		Rules     []string    `json:"rules"`
+		Ranges    []string    `json:"ranges"`
+	}{l.generated.UTC(), bans, rules, ranges})
+}
+
+// renderNft writes a script for nft -f that replaces the tban table with
+// one dropping the ranges in both directions.
+func renderNft(w io.Writer, l *exportList) error {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\ntable inet %s {\n", exportName, exportName, exportName)
+
+	for _, v := range []struct {
+		name, typ string
+		v6        bool
+	}{{"ip4set", "ipv4_addr", false}, {"ip6set", "ipv6_addr", true}} {
+		fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n", v.name, v.typ)
+
+		first := true
+		for _, r := range l.ranges {
+			if (r.familyLength() == net.IPv6len) != v.v6 {
+				continue
+			}
+			if first {
+				b.WriteString("\t\telements = {\n")
+				first = false
+			} else {
+				b.WriteString(",\n")
+			}
+			if r.start.Equal(r.end) {
+				fmt.Fprintf(&b, "\t\t\t%s", ipToString(r.start))
+			} else {
+				fmt.Fprintf(&b, "\t\t\t%s", r.String())
+			}
+		}
+		if !first {
+			b.WriteString("\n\t\t}\n")
+		}
+
+		b.WriteString("\t}\n\n")
+	}
+
+	for _, v := range []struct{ chain, dir string }{{"input", "saddr"}, {"output", "daddr"}} {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\ttype filter hook %s priority filter; policy accept;\n", v.chain, v.chain)
+		fmt.Fprintf(&b, "\t\tip %s @ip4set drop\n\t\tip6 %s @ip6set drop\n\t}\n", v.dir, v.dir)
+		if v.chain == "input" {
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// renderIpset writes a script for ipset restore that fills the tban-v4 and
+// tban-v6 sets, created when missing.
+func renderIpset(w io.Writer, l *exportList) error {
+	var b bytes.Buffer
+
+	for _, v := range []struct {
+		family string
+		v6     bool
+	}{{"inet", false}, {"inet6", true}} {
+		name := exportName + "-v4"
+		if v.v6 {
+			name = exportName + "-v6"
+		}
+
+		fmt.Fprintf(&b, "create %s hash:net family %s maxelem 1048576 -exist\nflush %s\n", name, v.family, name)
+		for _, n := range l.cidrs(v.v6) {
+			fmt.Fprintf(&b, "add %s %s\n", name, n.String())
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// renderMikrotik writes a RouterOS script that replaces the tban address
+// lists of IPv4 and IPv6.
+func renderMikrotik(w io.Writer, l *exportList) error {
+	var b bytes.Buffer
+
+	for _, v := range []struct {
+		menu string
+		v6   bool
+	}{{"/ip firewall address-list", false}, {"/ipv6 firewall address-list", true}} {
+		fmt.Fprintf(&b, "%s\nremove [find list=%s]\n", v.menu, exportName)
+		for _, n := range l.cidrs(v.v6) {
+			fmt.Fprintf(&b, "add list=%s address=%s\n", exportName, n.String())
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormats(t *testing.T) {
+	l := newExportList([]entry{
+		{time: 1700000000, addr: "192.0.2.1", client: "Xunlei", geo: Geo{ASN: 4134, Country: "CN"}},
+		{time: 1700000000, addr: "192.0.2.2", client: "Xunlei"},
+		{time: 1700000000, addr: "2001:db8::1", client: "QQDownload"},
+	}, []string{"198.51.100.0/24"}, time.Unix(1700000000, 0))
+
+	render := func(name string) string {
+		f, ok := lookupExport(name)
+		if !ok {
+			t.Fatal(name)
+		}
+		var b bytes.Buffer
+		if err := f.render(&b, l); err != nil {
+			t.Fatal(name, err)
+		}
+		return b.String()
+	}
+
+	for name, want := range map[string]string{
+		"emule.dat":       "192.000.002.001 - 192.000.002.002 , 000 , tban\n198.051.100.000 - 198.051.100.255 , 000 , tban\n",
+		"qbittorrent.dat": "192.0.2.1 - 192.0.2.2 , 000 , tban\n198.51.100.0 - 198.51.100.255 , 000 , tban\n2001:db8::1 - 2001:db8::1 , 000 , tban\n",
+		"cidr4.txt":       "192.0.2.1/32\n192.0.2.2/32\n198.51.100.0/24\n",
+		"cidr6.txt":       "2001:db8::1/128\n",
+	} {
+		if got := render(name); got != want {
+			t.Fatal(name, got)
+		}
+	}
+
+	for name, want := range map[string][]string{
+		"blocklist.nft": {"delete table inet tban\n", "192.0.2.1-192.0.2.2,\n\t\t\t198.51.100.0-198.51.100.255\n", "\t\t\t2001:db8::1\n", "ip6 daddr @ip6set drop"},
+		"ipset.txt":     {"flush tban-v4\nadd tban-v4 192.0.2.1/32\n", "create tban-v6 hash:net family inet6", "add tban-v6 2001:db8::1/128\n"},
+		"mikrotik.rsc":  {"/ip firewall address-list\nremove [find list=tban]\nadd list=tban address=192.0.2.1/32\n", "/ipv6 firewall address-list\nremove [find list=tban]\nadd list=tban address=2001:db8::1/128\n"},
+	} {
+		got := render(name)
+		for _, v := range want {
+			if !strings.Contains(got, v) {
+				t.Fatal(name, v, got)
+			}
+		}
+	}
+
+	var v struct {
+		Bans   []exportBan `json:"bans"`
+		Rules  []string    `json:"rules"`
+		Ranges []string    `json:"ranges"`
+	}
+	if err := json.Unmarshal([]byte(render("blocklist.json")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Bans) != 3 || v.Bans[0].Country != "CN" || len(v.Rules) != 1 || len(v.Ranges) != 3 {
+		t.Fatal(v)
+	}
+}
+
+func TestServeExports(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	if err := writeExports("blocklist.txt", newExportList([]entry{{addr: "192.0.2.1"}}, nil, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "export", "mikrotik.rsc.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHandler("blocklist.txt", nil, nil)
+	for path, want := range map[string]int{
+		"/export/cidr4.txt":         http.StatusOK,
+		"/export/cidr4.txt.gz":      http.StatusOK,
+		"/export/blocklist.json.gz": http.StatusOK,
+		"/export/unknown.txt":       http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Fatal(path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/export/cidr4.txt", nil))
+	if rec.Body.String() != "192.0.2.1/32\n" || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal(rec.Body.String(), rec.Header())
+	}
+	// HEAD counts the entries of the export, not of the blocklist
+	if err := writeBlocklist("blocklist.txt", []byte("a:192.0.2.1-192.0.2.1\nb:192.0.2.2-192.0.2.2\nc:192.0.2.3-192.0.2.3\n")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"/export/mikrotik.rsc":    "1",
+		"/export/mikrotik.rsc.gz": "1",
+		"/export/blocklist.nft":   "1",
+		"/export/blocklist.json":  "",
+		"/blocklist.txt":          "3",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("HEAD", path, nil))
+		if got := rec.Header().Get("X-Blocklist-Entries"); got != want {
+			t.Fatal(path, got)
+		}
+	}
+}
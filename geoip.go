@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hekmon/transmissionrpc/v3"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPConfig looks peers up in local MaxMind format databases, GeoLite2
+// ASN or Country, and bans or scores them by ASN or country.
+type GeoIPConfig struct {
+	// Databases are the mmdb files, the results of all of them are merged
+	Databases []string `yaml:"databases"`
+	// Rules are matched against the peers of public torrents only, private
+	// trackers are full of datacenter seedboxes
+	Rules []GeoRule `yaml:"rules"`
+}
+
+type GeoRule struct {
+	Name    string   `yaml:"name"`
+	ASN     []uint   `yaml:"asn,omitempty"`
+	Country []string `yaml:"country,omitempty"`
+	// Score is added to the reputation of the address on a match, 0 bans
+	// at once
+	Score float64 `yaml:"score,omitempty"`
+	// Shadow rules record their matches but never ban
+	Shadow bool `yaml:"shadow,omitempty"`
+}
+
+var countryRegexp = regexp.MustCompile(`^[A-Z]{2}$`)
+
+func (g GeoIPConfig) Validate() error {
+	var err error
+
+	if len(g.Rules) > 0 && len(g.Databases) == 0 {
+		err = errors.Join(err, errors.New("rules: no databases"))
+	}
+
+	for i, v := range g.Rules {
+		if v.Name == "" {
+			err = errors.Join(err, fmt.Errorf("rules[%d]: name must not be empty", i))
+		}
+		if len(v.ASN) == 0 && len(v.Country) == 0 {
+			err = errors.Join(err, fmt.Errorf("rules[%d]: no asn or country", i))
+		}
+		for _, c := range v.Country {
+			if !countryRegexp.MatchString(c) {
+				err = errors.Join(err, fmt.Errorf("rules[%d]: invalid country %q, use ISO codes such as CN", i, c))
+			}
+		}
+		if v.Score < 0 {
+			err = errors.Join(err, fmt.Errorf("rules[%d]: negative score", i))
+		}
+	}
+
+	return err
+}
+
+// Geo is what the databases know about an address.
+type Geo struct {
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// String is the short form used in the blocklist descriptions, such as
+// "AS4134 CN".
+func (g Geo) String() string {
+	var s []string
+	if g.ASN != 0 {
+		s = append(s, "AS"+strconv.FormatUint(uint64(g.ASN), 10))
+	}
+	if g.Country != "" {
+		s = append(s, g.Country)
+	}
+	return strings.Join(s, " ")
+}
+
+// GeoDB is the merged lookup of the configured databases, a nil GeoDB
+// knows nothing.
+type GeoDB struct {
+	lookups []func(addr netip.Addr) (Geo, bool)
+}
+
+// geoRecord covers the GeoLite2 ASN and Country layouts.
+type geoRecord struct {
+	ASN     uint   `maxminddb:"autonomous_system_number"`
+	Org     string `maxminddb:"autonomous_system_organization"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// openGeoDB reads the databases into memory, so a reload can drop the old
+// ones while a scan still uses them.
+func openGeoDB(paths []string) (*GeoDB, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	g := &GeoDB{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := maxminddb.FromBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		g.lookups = append(g.lookups, func(addr netip.Addr) (Geo, bool) {
+			var rec geoRecord
+			_, ok, err := r.LookupNetwork(net.IP(addr.AsSlice()), &rec)
+			if err != nil || !ok {
+				return Geo{}, false
+			}
+			return Geo{ASN: rec.ASN, Org: rec.Org, Country: rec.Country.ISOCode}, true
+		})
+	}
+
+	return g, nil
+}
+
+// Lookup merges what each database knows about addr.
+func (g *GeoDB) Lookup(addr netip.Addr) (Geo, bool) {
+	if g == nil {
+		return Geo{}, false
+	}
+
+	var (
+		resp  Geo
+		found bool
+	)
+
+	addr = addr.Unmap()
+	for _, f := range g.lookups {
+		v, ok := f(addr)
+		if !ok {
+			continue
+		}
+
+		found = true
+		if resp.ASN == 0 {
+			resp.ASN, resp.Org = v.ASN, v.Org
+		}
+		if resp.Country == "" {
+			resp.Country = v.Country
+		}
+	}
+
+	return resp, found
+}
+
+// LookupString looks up a peer address as reported by the torrent client.
+func (g *GeoDB) LookupString(addr string) (Geo, bool) {
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return Geo{}, false
+	}
+	return g.Lookup(a)
+}
+
+// Match returns the hit of r if geo is in one of its asns or countries.
+func (r GeoRule) Match(geo Geo) (Hit, bool) {
+	h := Hit{Detector: r.Name, Score: r.Score, Shadow: r.Shadow}
+
+	if geo.ASN != 0 && slices.Contains(r.ASN, geo.ASN) {
+		h.Rule = "AS" + strconv.FormatUint(uint64(geo.ASN), 10)
+		return h, true
+	}
+
+	if geo.Country != "" && slices.Contains(r.Country, geo.Country) {
+		h.Rule = "country:" + geo.Country
+		return h, true
+	}
+
+	return Hit{}, false
+}
+
+// geoHits returns the hits of every matching rule.
+func geoHits(rules []GeoRule, geo Geo) []Hit {
+	var resp []Hit
+	for _, r := range rules {
+		if h, ok := r.Match(geo); ok {
+			resp = append(resp, h)
+		}
+	}
+	return resp
+}
+
+// matchPeers reports whether any peer of v is in one of the asns or
+// countries.
+func (g *GeoDB) matchPeers(v transmissionrpc.Torrent, asns []uint, countries []string) bool {
+	return slices.ContainsFunc(v.Peers, func(p transmissionrpc.Peer) bool {
+		geo, ok := g.LookupString(p.Address)
+		if !ok {
+			return false
+		}
+		return (geo.ASN != 0 && slices.Contains(asns, geo.ASN)) ||
+			(geo.Country != "" && slices.Contains(countries, geo.Country))
+	})
+}
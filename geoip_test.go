@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func testGeoDB() *GeoDB {
+	return &GeoDB{lookups: []func(netip.Addr) (Geo, bool){
+		func(addr netip.Addr) (Geo, bool) {
+			if netip.MustParsePrefix("36.102.218.0/24").Contains(addr) {
+				return Geo{ASN: 4134, Org: "CHINANET-BACKBONE"}, true
+			}
+			return Geo{}, false
+		},
+		func(addr netip.Addr) (Geo, bool) {
+			if netip.MustParsePrefix("36.0.0.0/8").Contains(addr) {
+				return Geo{Country: "CN"}, true
+			}
+			return Geo{}, false
+		},
+	}}
+}
+
+func TestGeoDB(t *testing.T) {
+	g := testGeoDB()
+
+	geo, ok := g.LookupString("::ffff:36.102.218.7")
+	if !ok || geo.ASN != 4134 || geo.Country != "CN" || geo.String() != "AS4134 CN" {
+		t.Fatal(geo, ok)
+	}
+
+	if _, ok := (*GeoDB)(nil).LookupString("36.102.218.7"); ok {
+		t.Fatal("nil GeoDB found an address")
+	}
+
+	rules := []GeoRule{
+		{Name: "chinanet", ASN: []uint{4134}},
+		{Name: "country", Country: []string{"CN"}, Score: 20, Shadow: true},
+	}
+
+	hits := geoHits(rules, geo)
+	if len(hits) != 2 || hits[0].Rule != "AS4134" || hits[1].Rule != "country:CN" || !hits[1].Shadow {
+		t.Fatal(hits)
+	}
+
+	m := PolicyMatch{PeerASN: []uint{4134}}
+	if !m.Match(transmissionrpc.Torrent{Peers: []transmissionrpc.Peer{{Address: "36.102.218.7"}}}, g) {
+		t.Fatal("peer asn not matched")
+	}
+	if m.Match(transmissionrpc.Torrent{Peers: []transmissionrpc.Peer{{Address: "1.1.1.1"}}}, g) {
+		t.Fatal("peer asn matched")
+	}
+}
+
+func TestBanRecordGeo(t *testing.T) {
+	r := NewT(1, "Xunlei 0019", Geo{ASN: 4134, Country: "CN"})
+	if r.Time() != 1 || r.Client() != "Xunlei 0019" || r.Geo() != (Geo{ASN: 4134, Country: "CN"}) {
+		t.Fatal(r.Time(), r.Client(), r.Geo())
+	}
+
+	e := entry{client: r.Client(), geo: r.Geo()}
+	if e.description() != "Xunlei 0019 AS4134 CN" {
+		t.Fatal(e.description())
+	}
+
+	// records written before the geo lookup
+	old := NewT(1, "Xunlei 0019", Geo{})
+	if old.Client() != "Xunlei 0019" || old.Geo() != (Geo{}) {
+		t.Fatal(old.Client(), old.Geo())
+	}
+}
@@ -4,12 +4,17 @@ go 1.23.1
 
 require (
 	github.com/coreos/go-iptables v0.8.0
+	github.com/coreos/go-systemd/v22 v22.7.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/google/nftables v0.2.1-0.20240909063505-2fecffcfe11c
 	github.com/hekmon/cunits/v2 v2.1.0
 	github.com/hekmon/transmissionrpc/v3 v3.0.0
+	github.com/oschwald/maxminddb-golang v1.13.1
 	github.com/samber/lo v1.47.0
+	github.com/vishvananda/netlink v1.1.1-0.20211118161826-650dca95af54
 	go.etcd.io/bbolt v1.4.0-beta.0
 	golang.org/x/sys v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 	gvisor.dev/gvisor v0.0.0-20250416204613-04a61c0f3bd5
 )
 
@@ -19,6 +24,7 @@ require (
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/netlink v1.7.2 // indirect
 	github.com/mdlayher/socket v0.5.0 // indirect
+	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f // indirect
 	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+	"go.etcd.io/bbolt"
+)
+
+// HoneypotConfig keeps decoy torrents of random data seeding on public
+// trackers. Nobody is told about them, so any peer that asks a decoy for
+// data scraped the tracker and connects to everything, it is banned at
+// once with the "honeypot" rule whatever client it claims to be.
+type HoneypotConfig struct {
+	// Count is the number of decoys to keep, 0 removes them
+	Count int `yaml:"count"`
+	// Dir holds the decoy data, transmission must be able to read it
+	Dir      string   `yaml:"dir"`
+	Size     Size     `yaml:"size"`
+	Trackers []string `yaml:"trackers"`
+	// Rotate replaces decoys older than this, 0 keeps them
+	Rotate time.Duration `yaml:"rotate"`
+	// Label is set on the decoys, torrents with it are never touched by
+	// policies
+	Label string `yaml:"label"`
+}
+
+const honeypotRule = "honeypot"
+
+func defaultHoneypot() HoneypotConfig {
+	return HoneypotConfig{Size: 16 * MiB, Rotate: time.Hour * 24 * 7, Label: "tban-honeypot"}
+}
+
+func (h HoneypotConfig) Validate() error {
+	if h.Count < 0 {
+		return errors.New("count: negative value")
+	}
+
+	if h.Count == 0 {
+		return nil
+	}
+
+	var err error
+
+	if !filepath.IsAbs(h.Dir) {
+		err = errors.Join(err, fmt.Errorf("dir: %q is not an absolute path", h.Dir))
+	}
+
+	if h.Size < MiB || h.Size > 1024*MiB {
+		err = errors.Join(err, fmt.Errorf("size: %v is not between 1MiB and 1GiB", h.Size))
+	}
+
+	if len(h.Trackers) == 0 {
+		err = errors.Join(err, errors.New("trackers: must not be empty"))
+	}
+
+	for i, v := range h.Trackers {
+		u, er := url.Parse(v)
+		if er != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+			err = errors.Join(err, fmt.Errorf("trackers[%d]: invalid announce url %q", i, v))
+		}
+	}
+
+	if h.Rotate < 0 {
+		err = errors.Join(err, errors.New("rotate: negative value"))
+	}
+
+	return err
+}
+
+// isDecoy reports whether v is a decoy of hashes or carries the label.
+func (h HoneypotConfig) isDecoy(v transmissionrpc.Torrent, hashes map[string]bool) bool {
+	if v.HashString != nil && hashes[*v.HashString] {
+		return true
+	}
+	return h.Label != "" && slices.Contains(v.Labels, h.Label)
+}
+
+// honeypotHit reports whether a peer of a decoy takes data from it. Being
+// interested alone is not enough, clients announce interest in any torrent
+// they have not completed before they see a piece.
+func honeypotHit(p *transmissionrpc.Peer) (Hit, bool) {
+	if !p.IsUploadingTo && p.RateToPeer <= 0 {
+		return Hit{}, false
+	}
+	return Hit{Detector: honeypotRule, Rule: honeypotRule}, true
+}
+
+type decoy struct {
+	Hash    string    `json:"hash"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Missing counts the scans in a row the decoy was not listed
+	Missing int `json:"missing,omitempty"`
+}
+
+// decoyMissingScans is the number of scans in a row a decoy has to be
+// missing from the listing before it is forgotten and its data removed, a
+// single listing may miss torrents while transmission is busy.
+const decoyMissingScans = 10
+
+var honeypotBucket = []byte("honeypot")
+
+func (d *DB) decoys() ([]decoy, error) {
+	var resp []decoy
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(honeypotBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var x decoy
+			if err := json.Unmarshal(v, &x); err == nil {
+				resp = append(resp, x)
+			}
+			return nil
+		})
+	})
+
+	slices.SortFunc(resp, func(a, b decoy) int { return a.Created.Compare(b.Created) })
+
+	return resp, err
+}
+
+func (d *DB) putDecoy(x decoy) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(honeypotBucket)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(x.Hash), buf)
+	})
+}
+
+func (d *DB) deleteDecoy(hash string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(honeypotBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(hash))
+	})
+}
+
+// honeypots manages the decoys of the scanned torrents at: decoys gone from
+// transmission for decoyMissingScans scans are forgotten, expired and extra
+// ones removed, missing ones created. It returns the hashes of the live
+// decoys.
+func (t *TBan) honeypots(ctx context.Context, cli TorrentClient, h HoneypotConfig, at []transmissionrpc.Torrent) map[string]bool {
+	resp := map[string]bool{}
+
+	decoys, err := t.db.decoys()
+	if err != nil {
+		slog.Error("honeypot", "err", err)
+		return resp
+	}
+
+	present := map[string]bool{}
+	for _, v := range at {
+		if v.HashString != nil {
+			present[*v.HashString] = true
+		}
+	}
+
+	live := 0
+	// newest first, so the oldest decoys are the extra ones
+	for _, v := range slices.Backward(decoys) {
+		if !present[v.Hash] {
+			v.Missing++
+			if v.Missing < decoyMissingScans {
+				slog.Warn("honeypot missing", "name", v.Name, "scans", v.Missing)
+				_ = t.db.putDecoy(v)
+				continue
+			}
+
+			// removed by hand, the data is ours to clean up
+			slog.Info("honeypot gone", "name", v.Name)
+			_ = os.RemoveAll(filepath.Join(h.Dir, v.Name))
+			_ = t.db.deleteDecoy(v.Hash)
+			continue
+		}
+
+		if v.Missing > 0 {
+			v.Missing = 0
+			_ = t.db.putDecoy(v)
+		}
+
+		if live < h.Count && (h.Rotate == 0 || time.Since(v.Created) < h.Rotate) {
+			live++
+			resp[v.Hash] = true
+			continue
+		}
+
+		slog.Info("honeypot remove", "name", v.Name)
+		if err := cli.RemoveTorrents(ctx, []string{v.Hash}, true); err != nil {
+			slog.Error("honeypot remove", "name", v.Name, "err", err)
+			resp[v.Hash] = true
+			continue
+		}
+		_ = t.db.deleteDecoy(v.Hash)
+	}
+
+	for ; live < h.Count; live++ {
+		x, err := t.addDecoy(ctx, cli, h)
+		if err != nil {
+			slog.Error("honeypot add", "err", err)
+			break
+		}
+		slog.Info("honeypot add", "name", x.Name, "hash", x.Hash)
+		resp[x.Hash] = true
+	}
+
+	return resp
+}
+
+func (t *TBan) addDecoy(ctx context.Context, cli TorrentClient, h HoneypotConfig) (decoy, error) {
+	dc, ok := cli.(DecoyClient)
+	if !ok {
+		return decoy{}, errors.New("the client does not support decoys")
+	}
+
+	x, meta, err := newDecoy(h.Dir, int64(h.Size), h.Trackers)
+	if err != nil {
+		return x, err
+	}
+
+	var labels []string
+	if h.Label != "" {
+		labels = []string{h.Label}
+	}
+
+	if err := dc.AddTorrent(ctx, meta, h.Dir, labels); err != nil {
+		_ = os.RemoveAll(filepath.Join(h.Dir, x.Name))
+		return x, err
+	}
+
+	return x, t.db.putDecoy(x)
+}
+
+const decoyPieceLength = 256 * 1024
+
+// newDecoy writes size bytes of random data into dir and returns the
+// single file metainfo of it.
+func newDecoy(dir string, size int64, trackers []string) (decoy, []byte, error) {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	name := hex.EncodeToString(id[:]) + ".bin"
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return decoy{}, nil, err
+	}
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return decoy{}, nil, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	r := io.TeeReader(io.LimitReader(rand.Reader, size), w)
+
+	var pieces bytes.Buffer
+	buf := make([]byte, decoyPieceLength)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces.Write(sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return decoy{}, nil, err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return decoy{}, nil, err
+	}
+
+	info := map[string]any{
+		"name":         name,
+		"length":       size,
+		"piece length": decoyPieceLength,
+		"pieces":       pieces.String(),
+	}
+	infoHash := sha1.Sum(bencode(info))
+
+	var tiers []any
+	for _, v := range trackers {
+		tiers = append(tiers, []any{v})
+	}
+
+	meta := bencode(map[string]any{
+		"announce":      trackers[0],
+		"announce-list": tiers,
+		"creation date": time.Now().Unix(),
+		"info":          info,
+	})
+
+	return decoy{Hash: hex.EncodeToString(infoHash[:]), Name: name, Created: time.Now()}, meta, nil
+}
+
+// bencode encodes strings, integers, lists and dictionaries.
+func bencode(v any) []byte {
+	var b bytes.Buffer
+	bencodeTo(&b, v)
+	return b.Bytes()
+}
+
+func bencodeTo(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		b.WriteString(strconv.Itoa(len(v)))
+		b.WriteByte(':')
+		b.WriteString(v)
+	case int:
+		fmt.Fprintf(b, "i%de", v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case []any:
+		b.WriteByte('l')
+		for _, x := range v {
+			bencodeTo(b, x)
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		b.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(b, k)
+			bencodeTo(b, v[k])
+		}
+		b.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
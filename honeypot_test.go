@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestBencode(t *testing.T) {
+	b := bencode(map[string]any{"b": []any{"x", 1}, "a": int64(-2)})
+	if string(b) != "d1:ai-2e1:bl1:xi1eee" {
+		t.Fatal(string(b))
+	}
+}
+
+func TestNewDecoy(t *testing.T) {
+	dir := t.TempDir()
+
+	x, meta, err := newDecoy(dir, decoyPieceLength*2+100, []string{"udp://tracker.example.org:1337/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, x.Name))
+	if err != nil || fi.Size() != decoyPieceLength*2+100 {
+		t.Fatal(fi, err)
+	}
+
+	// 3 pieces of 20 bytes
+	if !bytes.Contains(meta, []byte("6:pieces60:")) || len(x.Hash) != 40 {
+		t.Fatal(x, string(meta[:100]))
+	}
+	t.Log(x)
+}
+
+func TestHoneypotHit(t *testing.T) {
+	h := defaultHoneypot()
+	hash := "abc"
+
+	if !h.isDecoy(transmissionrpc.Torrent{HashString: &hash}, map[string]bool{hash: true}) ||
+		!h.isDecoy(transmissionrpc.Torrent{Labels: []string{h.Label}}, nil) ||
+		h.isDecoy(transmissionrpc.Torrent{HashString: &hash}, nil) {
+		t.Fatal("isDecoy")
+	}
+
+	if _, ok := honeypotHit(&transmissionrpc.Peer{}); ok {
+		t.Fatal("idle peer hit")
+	}
+
+	if _, ok := honeypotHit(&transmissionrpc.Peer{PeerIsInterested: true}); ok {
+		t.Fatal("interested peer hit")
+	}
+
+	if v, ok := honeypotHit(&transmissionrpc.Peer{PeerIsInterested: true, IsUploadingTo: true}); !ok || v.Rule != "honeypot" || v.Score != 0 {
+		t.Fatal(v, ok)
+	}
+}
+
+func TestHoneypotMissing(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := defaultHoneypot()
+	h.Dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(h.Dir, "decoy.bin"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.putDecoy(decoy{Hash: "abc", Name: "decoy.bin", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a listing without the decoy keeps its data and record
+	tb := &TBan{db: db}
+	for range decoyMissingScans - 1 {
+		tb.honeypots(context.Background(), nil, h, nil)
+	}
+	if _, err := os.Stat(filepath.Join(h.Dir, "decoy.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := db.decoys(); err != nil || len(ds) != 1 || ds[0].Missing != decoyMissingScans-1 {
+		t.Fatal(ds, err)
+	}
+
+	tb.honeypots(context.Background(), nil, h, nil)
+	if _, err := os.Stat(filepath.Join(h.Dir, "decoy.bin")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if ds, err := db.decoys(); err != nil || len(ds) != 0 {
+		t.Fatal(ds, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Instance is one torrent client managed by the daemon. Bans, the db, the
+// firewall and the blocklist are shared by all instances.
+type Instance struct {
+	Name string `yaml:"name"`
+	// Client is the backend of rpc: transmission, qbittorrent or deluge
+	Client   string `yaml:"client"`
+	RPC      string `yaml:"rpc"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// BlocklistURL replaces the top level blocklist_url for this instance
+	BlocklistURL string `yaml:"blocklist_url,omitempty"`
+	// BlocklistDir is the config dir of a transmission on the same host,
+	// the blocklist is written into its blocklists dir
+	BlocklistDir string `yaml:"blocklist_dir,omitempty"`
+
+	// Policies replace the top level policies for this instance when set
+	Policies []Policy `yaml:"policies,omitempty"`
+	// PrivatePolicies replace private.policies for this instance when set
+	PrivatePolicies []Policy `yaml:"private_policies,omitempty"`
+}
+
+func (i Instance) Validate() error {
+	var err error
+
+	if i.Name == "" {
+		err = errors.Join(err, errors.New("name: must not be empty"))
+	}
+
+	switch i.Client {
+	case ClientTransmission, ClientQBittorrent, ClientDeluge:
+	default:
+		err = errors.Join(err, fmt.Errorf("client: unknown client %q", i.Client))
+	}
+
+	u, er := url.Parse(i.RPC)
+	if er != nil {
+		err = errors.Join(err, fmt.Errorf("rpc: %w", er))
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		err = errors.Join(err, fmt.Errorf("rpc: unsupported scheme %q", u.Scheme))
+	}
+
+	if i.BlocklistURL != "" {
+		if u, er := url.Parse(i.BlocklistURL); er != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			err = errors.Join(err, fmt.Errorf("blocklist_url: %q is not an http url", i.BlocklistURL))
+		}
+	}
+
+	if i.BlocklistDir != "" && i.Client != ClientTransmission {
+		err = errors.Join(err, fmt.Errorf("blocklist_dir: %s does not read a blocklist dir", i.Client))
+	}
+
+	if er := validatePolicies(i.Policies); er != nil {
+		err = errors.Join(err, fmt.Errorf("policies%w", er))
+	}
+
+	if er := validatePolicies(i.PrivatePolicies); er != nil {
+		err = errors.Join(err, fmt.Errorf("private_policies%w", er))
+	}
+
+	return err
+}
+
+// validatePolicies checks each policy and that the names are unique, errors
+// start with the index such as "[1]: ...".
+func validatePolicies(ps []Policy) error {
+	var err error
+
+	names := map[string]bool{}
+	for i, v := range ps {
+		if er := v.Validate(); er != nil {
+			err = errors.Join(err, fmt.Errorf("[%d]: %w", i, er))
+		}
+		if names[v.Name] {
+			err = errors.Join(err, fmt.Errorf("[%d]: duplicate name %q", i, v.Name))
+		}
+		names[v.Name] = true
+	}
+
+	return err
+}
+
+// instances returns the configured instances, or the single one described
+// by the top level client, rpc, username, password and blocklist_dir.
+func (c *Config) instances() []Instance {
+	if len(c.Instances) > 0 {
+		return c.Instances
+	}
+
+	return []Instance{{
+		Name:     "default",
+		Client:   c.Client,
+		RPC:      c.RPC,
+		Username: c.Username,
+		Password: c.Password,
+
+		BlocklistDir: c.BlocklistDir,
+	}}
+}
+
+// policies returns the public and private policies of the named instance.
+func (c *Config) policies(name string) ([]Policy, []Policy) {
+	public, private := c.Policies, c.Private.Policies
+
+	for _, v := range c.Instances {
+		if v.Name != name {
+			continue
+		}
+		if v.Policies != nil {
+			public = v.Policies
+		}
+		if v.PrivatePolicies != nil {
+			private = v.PrivatePolicies
+		}
+	}
+
+	return public, private
+}
+
+// sameInstances reports whether the connections of a and b are the same,
+// the policies are not compared.
+func sameInstances(a, b []Instance) bool {
+	return slices.EqualFunc(a, b, func(x, y Instance) bool {
+		return x.Name == y.Name && x.Client == y.Client && x.RPC == y.RPC &&
+			x.Username == y.Username && x.Password == y.Password
+	})
+}
+
+// instance is a connected Instance and the status of its last run.
+type instance struct {
+	name string
+	cli  TorrentClient
+	// rpc is cli, nil when the client is not wrapped
+	rpc *resilientClient
+	// blocklistSet is true once the blocklist settings were checked
+	blocklistSet bool
+	// blocklistSum is the sha256 of the blocklist the client last reloaded
+	blocklistSum [sha256.Size]byte
+
+	mu     sync.Mutex
+	status InstanceStatus
+}
+
+type InstanceStatus struct {
+	Name   string `json:"name"`
+	Client string `json:"client"`
+	RPC    string `json:"rpc"`
+
+	LastRun time.Time    `json:"last_run"`
+	Error   string       `json:"error,omitempty"`
+	Health  ClientHealth `json:"health"`
+	// BlocklistDrift is true when the blocklist settings of the client
+	// were changed to another url or disabled
+	BlocklistDrift bool `json:"blocklist_drift"`
+
+	Torrents int `json:"torrents"`
+	Peers    int `json:"peers"`
+	// Banned is the number of peers of this instance banned by the last run
+	Banned int `json:"banned"`
+
+	Policies []PolicyStatus `json:"policies"`
+}
+
+// PolicyStatus is the number of torrents a policy was applied to in the
+// last run.
+type PolicyStatus struct {
+	Name     string `json:"name"`
+	Private  bool   `json:"private"`
+	Action   string `json:"action"`
+	Torrents int    `json:"torrents"`
+}
+
+func newInstance(v Instance) (*instance, error) {
+	cli, err := newClient(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", v.Name, err)
+	}
+
+	rpc := v.RPC
+	if u, err := url.Parse(v.RPC); err == nil {
+		rpc = u.Redacted()
+	}
+
+	rc := newResilientClient(v.Name, cli)
+
+	return &instance{
+		name:   v.Name,
+		cli:    rc,
+		rpc:    rc,
+		status: InstanceStatus{Name: v.Name, Client: v.Client, RPC: rpc, Policies: []PolicyStatus{}},
+	}, nil
+}
+
+func (i *instance) Status() InstanceStatus {
+	i.mu.Lock()
+	s := i.status
+	i.mu.Unlock()
+
+	if i.rpc != nil {
+		s.Health = i.rpc.Health()
+	}
+	return s
+}
+
+func (i *instance) setStatus(f func(s *InstanceStatus)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	f(&i.status)
+}
+
+func policyStatus(plans []PolicyPlan, private bool) []PolicyStatus {
+	resp := make([]PolicyStatus, 0, len(plans))
+	for _, v := range plans {
+		resp = append(resp, PolicyStatus{
+			Name:     v.Policy.Name,
+			Private:  private,
+			Action:   v.Policy.Action,
+			Torrents: len(v.Torrents),
+		})
+	}
+	return resp
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// fakeClient is an in memory TorrentClient.
+type fakeClient struct {
+	mu       sync.Mutex
+	torrents []transmissionrpc.Torrent
+	err      error
+
+	banned   []netip.AddrPort
+	stopped  []string
+	started  []string
+	reloaded int
+	removes  int
+}
+
+func (f *fakeClient) Torrents(context.Context) ([]transmissionrpc.Torrent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.torrents, f.err
+}
+
+func (f *fakeClient) ReloadBlocklist(context.Context) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reloaded++
+	return 0, f.err
+}
+
+func (f *fakeClient) StopTorrents(_ context.Context, hashes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = append(f.stopped, hashes...)
+	return f.err
+}
+
+func (f *fakeClient) StartTorrents(_ context.Context, hashes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = append(f.started, hashes...)
+	return f.err
+}
+
+func (f *fakeClient) BanPeers(_ context.Context, peers []netip.AddrPort) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.banned = append(f.banned, peers...)
+	return f.err
+}
+
+func (f *fakeClient) RemoveTorrents(context.Context, []string, bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removes++
+	return f.err
+}
+
+func (f *fakeClient) MoveTorrents(context.Context, []string, string) error { return f.err }
+
+func (f *fakeClient) LimitTorrents(context.Context, []string, int64) error { return f.err }
+
+func fakeTorrent(hash string, private bool, peers ...transmissionrpc.Peer) transmissionrpc.Torrent {
+	status := transmissionrpc.TorrentStatusSeed
+	return transmissionrpc.Torrent{HashString: &hash, Name: &hash, Status: &status, IsPrivate: &private, Peers: peers}
+}
+
+func TestInstances(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := NewDB(filepath.Join(dir, "blocklist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// private torrents are not restarted, the run does not wait for it
+	a := &fakeClient{torrents: []transmissionrpc.Torrent{
+		fakeTorrent("aa", true, transmissionrpc.Peer{Address: "192.0.2.1", Port: 6881, ClientName: "Xunlei 0.0.1.2"}),
+	}}
+	b := &fakeClient{torrents: []transmissionrpc.Torrent{
+		fakeTorrent("bb", true, transmissionrpc.Peer{Address: "192.0.2.1", Port: 6882, ClientName: "Transmission 4.0.0"}),
+	}}
+	down := &fakeClient{err: errors.New("connection refused")}
+
+	tban := &TBan{db: db, path: filepath.Join(dir, "blocklist.txt")}
+	for i, cli := range []*fakeClient{a, b, down} {
+		tban.instances = append(tban.instances, &instance{name: string(rune('a' + i)), cli: cli})
+	}
+
+	if _, err := tban.run(context.Background()); err == nil || !strings.Contains(err.Error(), "c: connection refused") {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(tban.path)
+	if err != nil || !strings.Contains(string(data), "192.0.2.1") {
+		t.Fatal(string(data), err)
+	}
+
+	// the ban found on a is applied to b too
+	if len(a.banned) != 1 || a.banned[0].Port() != 6881 || len(b.banned) != 1 || b.banned[0].Port() != 6882 {
+		t.Fatal(a.banned, b.banned)
+	}
+	if a.reloaded != 1 || b.reloaded != 1 {
+		t.Fatal(a.reloaded, b.reloaded)
+	}
+
+	rec := httptest.NewRecorder()
+	newHandler(tban.path, db, tban.Status).ServeHTTP(rec, httptest.NewRequest("GET", "/api/instances", nil))
+
+	var status []InstanceStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status) != 3 || status[0].Banned != 1 || status[0].Peers != 1 || status[1].Banned != 1 || status[2].Error == "" {
+		t.Fatal(status)
+	}
+
+	// the same list is neither rewritten nor reloaded
+	before, _ := os.Stat(tban.path)
+	_, _ = tban.run(context.Background())
+	if after, _ := os.Stat(tban.path); !after.ModTime().Equal(before.ModTime()) || a.reloaded != 1 || b.reloaded != 1 {
+		t.Fatal(a.reloaded, b.reloaded)
+	}
+}
+
+func TestInstancePolicies(t *testing.T) {
+	c := defaultConfig()
+	c.Instances = []Instance{
+		{Name: "movies", Client: ClientTransmission, RPC: "http://127.0.0.1:9091/transmission/rpc",
+			Policies: []Policy{{Name: "keep", Action: PolicyActionLimit, UploadLimit: 100, Match: PolicyMatch{MinRatio: 1}}}},
+		{Name: "tv", Client: ClientQBittorrent, RPC: "http://127.0.0.1:8080"},
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if public, private := c.policies("movies"); len(public) != 1 || len(private) != len(c.Private.Policies) {
+		t.Fatal(public, private)
+	}
+	if public, _ := c.policies("tv"); len(public) != len(c.Policies) {
+		t.Fatal(public)
+	}
+
+	c.Instances = append(c.Instances, Instance{Name: "tv", Client: "rtorrent", RPC: "scgi://127.0.0.1"})
+	err := c.Validate()
+	for _, v := range []string{"duplicate name", "unknown client", "unsupported scheme"} {
+		if err == nil || !strings.Contains(err.Error(), v) {
+			t.Fatal(v, err)
+		}
+	}
+}
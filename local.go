@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// localBlocklist is the name of the blocklist written into the blocklists
+// directory of a transmission on the same host. Transmission converts every
+// file there on start into the file name with .bin appended, so this one
+// becomes blocklist.bin, the list blocklist-update replaces. Only one list
+// is loaded, whether it was converted on start or updated since.
+const localBlocklist = "blocklist"
+
+// legacyLocalBlocklists are the names earlier versions wrote and their
+// conversions, transmission would load them besides blocklist.bin.
+var legacyLocalBlocklists = []string{
+	"transmission-auto-ban.p2p", "transmission-auto-ban.p2p.bin", "transmission-auto-ban.bin",
+	"blocklist.p2p", "blocklist.p2p.bin",
+}
+
+// blocklistDir is the transmission config directory the named instance
+// reads the blocklist from, empty when the blocklist is served over http.
+func (c *Config) blocklistDir(name string) string {
+	for _, v := range c.instances() {
+		if v.Name == name {
+			return v.BlocklistDir
+		}
+	}
+	return ""
+}
+
+// localBlocklistPath is the blocklist inside the transmission config dir.
+func localBlocklistPath(dir string) string {
+	return filepath.Join(dir, "blocklists", localBlocklist)
+}
+
+// localBlocklistURL points transmission at the local file, blocklist-update
+// reads it with curl and replaces blocklist.bin without a request to the
+// http server.
+func localBlocklistURL(dir string) string {
+	u := url.URL{Scheme: "file", Path: localBlocklistPath(dir)}
+	return u.String()
+}
+
+// writeLocalBlocklist writes the P2P blocklist b into the blocklists dir
+// of the transmission config dir, transmission parses the file natively on
+// start and on blocklist-update. It reports whether the content changed.
+func writeLocalBlocklist(dir string, b []byte) (bool, error) {
+	path := localBlocklistPath(dir)
+
+	for _, v := range legacyLocalBlocklists {
+		if err := os.Remove(filepath.Join(filepath.Dir(path), v)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(old, b) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return true, writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
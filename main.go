@@ -2,22 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/netip"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/hekmon/cunits/v2"
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/hekmon/transmissionrpc/v3"
 	"go.etcd.io/bbolt"
 	"gvisor.dev/gvisor/pkg/tcpip"
@@ -27,163 +34,510 @@ type entry struct {
 	time   uint64
 	addr   string
 	client string
+	geo    Geo
 }
 
 func main() {
-	blockfile := flag.String("file", "blocklist.txt", "file path")
-	dbfile := flag.String("db", "blocklist.db", "blocklist db path")
-	rpc := flag.String("rpc", "http://127.0.0.1:9091/transmission/rpc", "transmission rpc url")
-	lishost := flag.String("host", ":9092", "listen host")
-	flag.BoolVar(&iptEnabled, "iptables", false, "enable iptables")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "check-config":
+			cmd = checkConfig
+		case "policy-report":
+			cmd = policyReport
+		case "shadow-report":
+			cmd = shadowReport
+		case "rule-stats":
+			cmd = ruleStatsReport
+		}
+
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	c, err := loadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: true,
-		Level:     slog.LevelDebug,
+		Level:     logLevel,
 	})))
-	db, err := NewDB(*dbfile)
-	if err != nil {
-		panic(err)
-	}
 
-	url, err := url.Parse(*rpc)
-	if err != nil {
-		panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, c); err != nil {
+		slog.Error("exit", "err", err)
+		stop()
+		os.Exit(1)
 	}
+}
 
-	cli, err := transmissionrpc.New(url, nil)
-	if err != nil {
-		panic(err)
+// run starts the daemon and blocks until ctx is canceled, it returns after
+// every worker stopped and the db is closed.
+func run(ctx context.Context, c *Config) error {
+	// the workers stop on ctx, canceled on shutdown and when serving fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	applyConfig(c)
+	iptEnabled = c.Iptables
+	TABLENAME = c.TableName
+
+	var instances []*instance
+	for _, v := range c.instances() {
+		inst, err := newInstance(v)
+		if err != nil {
+			return err
+		}
+		instances = append(instances, inst)
 	}
 
-	_, err = os.Stat(*blockfile)
+	_, err := os.Stat(c.File)
 	if err != nil && os.IsNotExist(err) {
-		_ = os.MkdirAll(filepath.Dir(*blockfile), 0755)
-		f, err := os.Create(*blockfile)
+		_ = os.MkdirAll(filepath.Dir(c.File), 0755)
+		f, err := os.Create(c.File)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		f.Close()
 	}
 
-	initRule(filepath.Dir(*dbfile))
+	db, err := NewDB(c.DB)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			slog.Error("close db", "err", err)
+		}
+	}()
+
+	db.loadUpload()
+
+	initRule(ctx, filepath.Dir(c.DB))
+
+	tban := &TBan{db: db, instances: instances, path: c.File, trigger: make(chan struct{}, 1)}
+
+	if err := watchRule(ctx, filepath.Dir(c.DB), tban.Trigger); err != nil {
+		slog.Error("watch rules failed", "err", err)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+
+			if err := reloadConfig(); err != nil {
+				slog.Error("reload config failed", "err", err)
+				continue
+			}
 
-	tban := &TBan{db, cli, *blockfile}
+			slog.Info("config reloaded")
+			tban.Trigger()
+		}
+	}()
 
+	wg.Add(1)
 	go func() {
-		timer := time.NewTicker(time.Minute * 2)
+		defer wg.Done()
+
+		interval := conf().ScanInterval
+		timer := time.NewTicker(interval)
 		defer timer.Stop()
 
-		tban.Run()
-		for range timer.C {
-			tban.Run()
+		tban.Run(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			case <-tban.trigger:
+			}
+
+			if d := conf().ScanInterval; d != interval {
+				interval = d
+				timer.Reset(d)
+			}
+
+			tban.Run(ctx)
 		}
 	}()
 
+	wg.Add(1)
 	go func() {
-		timer := time.NewTicker(time.Hour)
+		defer wg.Done()
+
+		// a changed feed_interval takes effect after the pending tick
+		interval := conf().FeedInterval
+		timer := time.NewTicker(interval)
 		defer timer.Stop()
 
-		for range timer.C {
-			refreshRule(filepath.Dir(*dbfile))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			if d := conf().FeedInterval; d != interval {
+				interval = d
+				timer.Reset(d)
+			}
+
+			refreshRule(ctx, filepath.Dir(c.DB))
 		}
 	}()
 
-	if err := http.ListenAndServe(*lishost, http.FileServer(&fm{*blockfile})); err != nil {
-		panic(err)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sdWatchdog(ctx, tban.alive)
+	}()
+
+	ls, err := listeners(c.Host)
+	if err != nil {
+		// the db is closed once the workers are done with it
+		cancel()
+		wg.Wait()
+		return err
+	}
+
+	srv := &http.Server{Handler: newHandler(c.File, db, tban.Status)}
+
+	errCh := make(chan error, len(ls))
+	for _, l := range ls {
+		go func() { errCh <- srv.Serve(l) }()
+	}
+
+	sdNotify(daemon.SdNotifyReady)
+
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case err = <-errCh:
+	}
+
+	sdNotify(daemon.SdNotifyStopping)
+
+	// a failed listener stops the workers too
+	cancel()
+
+	sctx, stop := context.WithTimeout(context.Background(), time.Second*10)
+	defer stop()
+
+	if er := srv.Shutdown(sctx); er != nil {
+		slog.Error("http shutdown", "err", er)
+	}
+
+	// wait for the in-flight run, it is canceled by ctx
+	wg.Wait()
+
+	if iptEnabled && conf().CleanupOnExit {
+		if er := nftCleanup(); er != nil {
+			slog.Error("nftables cleanup", "err", er)
+		}
 	}
-}
 
-func isToStop(v transmissionrpc.Torrent) bool {
-	if v.UploadRatio != nil && *v.UploadRatio >= 3 {
-		return true
-	} else if v.AddedDate != nil && time.Since(*v.AddedDate) > time.Hour*24*30*6 &&
-		v.TotalSize != nil && *v.TotalSize < cunits.Gibit*5 {
-		return true
-	} else if v.UploadRatio != nil && *v.UploadRatio >= 2.2 &&
-		v.AddedDate != nil && time.Since(*v.AddedDate) > time.Hour*24*30*3 &&
-		v.TotalSize != nil && *v.TotalSize < cunits.Gibit*5 {
-		return true
-	} else if v.AddedDate != nil && time.Since(*v.AddedDate) > time.Hour*24*30*12 {
-		return true
-	}
-
-	return false
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	return err
 }
 
 type TBan struct {
-	db   *DB
-	cli  *transmissionrpc.Client
-	path string
+	db        *DB
+	instances []*instance
+	path      string
+	// sum is the sha256 of the blocklist last written to path, exportSum
+	// the one of the list the exports were last written for
+	sum       [sha256.Size]byte
+	exportSum [sha256.Size]byte
+
+	// checks are the bans verified by the next run
+	checks map[string]*banCheck
+
+	trigger chan struct{}
+	// running is the unix time the current run started, 0 when idle
+	running atomic.Int64
 }
 
-func (t *TBan) Run() {
-	if err := t.run(); err != nil {
-		slog.Error("run", "err", err)
+// Trigger schedules a run without waiting for the next tick.
+func (t *TBan) Trigger() {
+	select {
+	case t.trigger <- struct{}{}:
+	default:
 	}
 }
 
-func (t *TBan) run() error {
-	at, err := t.cli.TorrentGetAll(context.Background())
+func (t *TBan) Run(ctx context.Context) {
+	now := time.Now()
+	t.running.Store(now.Unix())
+	defer t.running.Store(0)
+
+	banned, err := t.run(ctx)
 	if err != nil {
-		return err
+		slog.Error("run", "err", err)
 	}
 
+	sdStatus(now, err, banned, len(currentRules()))
+}
+
+// Status returns the status of every instance.
+func (t *TBan) Status() []InstanceStatus {
+	resp := make([]InstanceStatus, 0, len(t.instances))
+	for _, v := range t.instances {
+		resp = append(resp, v.Status())
+	}
+	return resp
+}
+
+// alive reports whether the run loop is idle or the current run is not
+// taking unreasonably long.
+func (t *TBan) alive() bool {
+	start := t.running.Load()
+	return start == 0 || time.Since(time.Unix(start, 0)) < conf().ScanInterval*3
+}
+
+// scan is what one run found on one instance.
+type scan struct {
+	inst *instance
+
+	seeds        []transmissionrpc.Torrent
+	privateSeeds []transmissionrpc.Torrent
+	// connected are the torrents each address is connected to
+	connected map[string][]peerTorrent
+	// fetched are the hashes of the listed torrents, true when their peer
+	// list was fetched
+	fetched   map[string]bool
+	peerPorts map[string]int64
+	peers     int
+}
+
+func (t *TBan) run(ctx context.Context) (int, error) {
+	c := conf()
+
 	clientAddress := []entry{}
-	torrents := []int64{}
-	stopTorrents := []int64{}
 
-	for _, v := range at {
-		if v.Status == nil || *v.Status != transmissionrpc.TorrentStatusSeed {
+	now := time.Now()
+	events := map[string][]ReputationEvent{}
+	shadows := []ShadowMatch{}
+	ruleHits := []ruleHit{}
+	peerGeo := map[string]Geo{}
+
+	var (
+		scans []*scan
+		errs  error
+	)
+
+	for i, inst := range t.instances {
+		at, err := inst.cli.Torrents(ctx)
+		if err != nil {
+			inst.setStatus(func(s *InstanceStatus) { s.LastRun, s.Error = now, err.Error() })
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", inst.name, err))
 			continue
 		}
 
-		if isToStop(v) {
-			stopTorrents = append(stopTorrents, *v.ID)
-		}
+		sc := &scan{inst: inst, connected: map[string][]peerTorrent{}, fetched: map[string]bool{}, peerPorts: map[string]int64{}}
+		scans = append(scans, sc)
 
-		if len(v.Peers) <= 0 {
-			continue
+		t.reconcileRestarts(ctx, c, inst, at)
+		t.syncBlocklistSettings(ctx, c, inst)
+
+		// decoys are seeded by the first instance, the label marks them
+		// on the others
+		var decoys map[string]bool
+		if i == 0 {
+			decoys = t.honeypots(ctx, inst.cli, c.Honeypot, at)
 		}
 
-		for _, p := range v.Peers {
-			if regexps.MatchString(p.ClientName, strings.ToLower(p.ClientName)) {
-				clientAddress = append(clientAddress, entry{addr: p.Address, client: p.ClientName})
-				if v.ID != nil {
-					torrents = append(torrents, *v.ID)
+		for _, v := range at {
+			sc.fetched[deref(v.HashString)] = v.Peers != nil
+
+			group := statusGroup(v)
+			if group == "" {
+				continue
+			}
+
+			sc.peers += len(v.Peers)
+
+			// decoys ban whoever asks them for data, they are never stopped,
+			// restarted or scanned by the detectors
+			if c.Honeypot.isDecoy(v, decoys) {
+				for _, p := range v.Peers {
+					sc.connected[p.Address] = append(sc.connected[p.Address], peerTorrent{hash: deref(v.HashString)})
+
+					h, ok := honeypotHit(&p)
+					if !ok {
+						continue
+					}
+
+					ruleHits = append(ruleHits, ruleHit{h.Detector, h.Rule, p.Address, p.ClientName})
+					events[p.Address] = append(events[p.Address], ReputationEvent{
+						Time:     now,
+						Detector: h.Detector,
+						Rule:     h.Rule,
+						Client:   p.ClientName,
+						Torrent:  deref(v.Name),
+						Points:   c.Reputation.points(h),
+					})
+					sc.peerPorts[p.Address] = p.Port
+					slog.Info("honeypot", "instance", inst.name, "address", p.Address, "client", p.ClientName, "torrent", deref(v.Name))
+				}
+				continue
+			}
+
+			private := c.Private.IsPrivate(v)
+			detectors := c.detectors[group]
+
+			if private {
+				detectors = c.privateDetectors[group]
+			}
+
+			if group == StatusSeed {
+				if private {
+					sc.privateSeeds = append(sc.privateSeeds, v)
+				} else {
+					sc.seeds = append(sc.seeds, v)
+				}
+			}
+
+			if len(v.Peers) <= 0 {
+				continue
+			}
+
+			for _, p := range v.Peers {
+				hits := detectAll(detectors, &v, &p)
+
+				if geo, ok := c.geo.LookupString(p.Address); ok {
+					peerGeo[p.Address] = geo
+					if !private {
+						hits = append(hits, geoHits(c.GeoIP.Rules, geo)...)
+					}
+				}
+
+				for _, h := range hits {
+					ruleHits = append(ruleHits, ruleHit{h.Detector, h.Rule, p.Address, p.ClientName})
+
+					if h.Shadow {
+						shadows = append(shadows, ShadowMatch{
+							Detector: h.Detector,
+							Rule:     h.Rule,
+							Addr:     p.Address,
+							Client:   p.ClientName,
+							Torrent:  deref(v.Name),
+							First:    now,
+							Last:     now,
+						})
+						slog.Debug("shadow", "instance", inst.name, "address", p.Address, "client", p.ClientName, "status", group,
+							"detector", h.Detector, "rule", h.Rule)
+						continue
+					}
+
+					events[p.Address] = append(events[p.Address], ReputationEvent{
+						Time:     now,
+						Detector: h.Detector,
+						Rule:     h.Rule,
+						Client:   p.ClientName,
+						Torrent:  deref(v.Name),
+						Points:   c.Reputation.points(h),
+					})
+					slog.Info("torrent", "instance", inst.name, "address", p.Address, "client", p.ClientName, "status", group,
+						"detector", h.Detector, "rule", h.Rule, "private", private)
 				}
-				slog.Info("torrent", "address", p.Address, "client", p.ClientName)
+
+				// private torrents are never restarted
+				sc.connected[p.Address] = append(sc.connected[p.Address], peerTorrent{hash: deref(v.HashString), restartable: !private})
+				sc.peerPorts[p.Address] = p.Port
 			}
 		}
+
+		inst.setStatus(func(s *InstanceStatus) {
+			s.LastRun, s.Error = now, ""
+			s.Torrents, s.Peers = len(at), sc.peers
+		})
 	}
 
-	t.db.addBlock(clientAddress...)
+	if len(scans) == 0 {
+		return 0, errs
+	}
 
-	defer func() {
-		entries, err := t.cli.BlocklistUpdate(context.Background())
-		if err != nil {
-			slog.Error("BlocklistUpdate", "err", err)
-		} else {
-			slog.Info("BlocklistUpdate", "entries", entries)
+	t.verifyBans(ctx, scans)
+
+	cycleDetectors(c.detectors, c.privateDetectors)
+	t.db.saveUpload()
+	t.db.recordShadow(shadows)
+	t.db.recordHits(ruleHits)
+
+	for _, r := range t.db.score(c.Reputation, events) {
+		clientAddress = append(clientAddress, entry{addr: r.Addr, client: r.Client(), geo: peerGeo[r.Addr]})
+		slog.Info("ban", "address", r.Addr, "client", r.Client(), "score", r.Score, "geo", peerGeo[r.Addr])
+	}
+
+	// every instance bans the peers it was connected to natively, if it can
+	for _, sc := range scans {
+		var banPeers []netip.AddrPort
+		for _, v := range clientAddress {
+			port, ok := sc.peerPorts[v.addr]
+			if !ok {
+				continue
+			}
+			if addr, err := netip.ParseAddr(v.addr); err == nil {
+				banPeers = append(banPeers, netip.AddrPortFrom(addr, uint16(port)))
+			}
 		}
-	}()
 
-	w, err := NewBlacklistWriter(t.path)
-	if err != nil {
-		return err
+		sc.inst.setStatus(func(s *InstanceStatus) { s.Banned = len(banPeers) })
+
+		if err := sc.inst.cli.BanPeers(ctx, banPeers); err != nil {
+			slog.Error("BanPeers", "instance", sc.inst.name, "err", err)
+		}
 	}
-	defer w.Close()
+
+	t.db.addBlock(clientAddress...)
+
+	// the list is rendered first, it is written to the served files and
+	// the blocklist dirs of the local instances
+	var w bytes.Buffer
 
 	addresses := []string{}
+	bans := []entry{}
 	t.db.rangeBlock(func(tx *bbolt.Bucket, v entry) {
 		addresses = append(addresses, v.addr)
-		_, _ = fmt.Fprintf(w, "Autogen[%s]:%s-%s\n", v.client, v.addr, v.addr)
-	}, time.Hour*24*2)
+		bans = append(bans, v)
+		_, _ = fmt.Fprintf(&w, "Autogen[%s]:%s-%s\n", v.description(), v.addr, v.addr)
+	}, c.BanExpiry)
+
+	rules := currentRules()
 
-	for _, v := range ips {
+	for _, v := range rules {
 		addr, err := netip.ParseAddr(v)
 		if err == nil {
-			_, _ = fmt.Fprintf(w, "Autogen[%s]:%s-%s\n", "pbh", addr.Unmap().String(), addr.Unmap().String())
+			_, _ = fmt.Fprintf(&w, "Autogen[%s]:%s-%s\n", "pbh", addr.Unmap().String(), addr.Unmap().String())
 			continue
 		}
 
@@ -194,77 +548,104 @@ func (t *TBan) run() error {
 			subnet := addr.Subnet()
 			last := subnet.Broadcast()
 
-			_, _ = fmt.Fprintf(w, "Autogen[%s]:%s-%s\n", "pbh", prefix.Addr().Unmap().String(), netip.MustParseAddr(last.String()).Unmap().String())
+			_, _ = fmt.Fprintf(&w, "Autogen[%s]:%s-%s\n", "pbh", prefix.Addr().Unmap().String(), netip.MustParseAddr(last.String()).Unmap().String())
 			continue
 		}
 
 		continue
 	}
 
-	if len(stopTorrents) > 0 {
-		slog.Info("stop torrents", "torrents", stopTorrents)
-		_ = t.cli.TorrentStopIDs(context.Background(), stopTorrents)
-	}
-
-	if iptEnabled {
-		if err := nft(append(addresses, ips...)); err != nil {
-			slog.Error("nftable apply failed", "err", err)
+	// the files are rewritten and the clients reload only when the list
+	// changed, the first run writes it anyway
+	sum := sha256.Sum256(w.Bytes())
+	if sum != t.sum {
+		if err := writeBlocklist(t.path, w.Bytes()); err != nil {
+			return 0, errors.Join(errs, err)
 		}
-
-		// if err := it(append(addresses, ips...)); err != nil {
-		// log.Println("it", err)
-		// }
+		t.sum = sum
 	} else {
-		restartTorrents(t.cli, torrents)
+		slog.Debug("blocklist unchanged", "entries", len(addresses))
 	}
 
-	return nil
-}
-
-func restartTorrents(cli *transmissionrpc.Client, torrents []int64) {
-	if len(torrents) == 0 {
-		return
+	// failed exports are written again on the next run
+	if sum != t.exportSum {
+		if err := writeExports(t.path, newExportList(bans, rules, time.Now())); err != nil {
+			slog.Error("export blocklist", "err", err)
+		} else {
+			t.exportSum = sum
+		}
 	}
 
-	slog.Info("restart torrents", "torrents", torrents)
+	for _, sc := range scans {
+		changed := false
+		if dir := c.blocklistDir(sc.inst.name); dir != "" {
+			var err error
+			changed, err = writeLocalBlocklist(dir, w.Bytes())
+			if err != nil {
+				slog.Error("local blocklist", "instance", sc.inst.name, "dir", dir, "err", err)
+				continue
+			}
+		}
 
-	err := cli.TorrentStopIDs(context.Background(), torrents)
-	if err != nil {
-		slog.Error("TorrentStopIDs failed", "err", err)
-		return
-	}
+		if !changed && sum == sc.inst.blocklistSum {
+			continue
+		}
 
-	for range 3 {
-		time.Sleep(time.Second * 3)
-		err = cli.TorrentStartIDs(context.Background(), torrents)
+		entries, err := sc.inst.cli.ReloadBlocklist(ctx)
 		if err != nil {
-			slog.Error("TorrentStartIDs", "err", err, "torrents", torrents)
+			slog.Error("ReloadBlocklist", "instance", sc.inst.name, "err", err)
 		} else {
-			break
+			sc.inst.blocklistSum = sum
+			slog.Info("ReloadBlocklist", "instance", sc.inst.name, "entries", entries)
 		}
 	}
-}
 
-type fm struct {
-	file string
-}
+	for _, sc := range scans {
+		public, private := c.policies(sc.inst.name)
+
+		plans := planPolicies(public, sc.seeds, c.geo)
+		privatePlans := planPolicies(private, c.Private.seeded(sc.privateSeeds), c.geo)
+
+		applyPolicies(ctx, sc.inst, plans)
+		applyPolicies(ctx, sc.inst, privatePlans)
+
+		sc.inst.setStatus(func(s *InstanceStatus) {
+			s.Policies = append(policyStatus(plans, false), policyStatus(privatePlans, true)...)
+		})
+	}
+
+	if iptEnabled {
+		if err := nft(append(addresses, rules...)); err != nil {
+			slog.Error("nftable apply failed", "err", err)
+		}
 
-func (f *fm) Open(name string) (http.File, error) {
-	tp := strings.TrimPrefix(name, "/")
-	if tp != f.file && tp != f.file+".gz" {
-		return nil, os.ErrNotExist
+		// if err := it(append(addresses, rules...)); err != nil {
+		// log.Println("it", err)
+		// }
 	}
 
-	return os.Open(f.file)
+	// the bans are checked on the next run
+	t.checkBans(clientAddress, scans)
+
+	return len(addresses), errs
 }
 
 type t []byte
 
-func NewT(time uint64, client string) t {
-	buf := make([]byte, 8+len(client))
+// NewT is the ban record, the time, the client and, when known, \0 asn \0
+// country.
+func NewT(time uint64, client string, geo Geo) t {
+	buf := make([]byte, 8, 8+len(client))
 
 	binary.BigEndian.PutUint64(buf, time)
-	copy(buf[8:], client)
+	buf = append(buf, client...)
+
+	if geo != (Geo{}) {
+		buf = append(buf, 0)
+		buf = strconv.AppendUint(buf, uint64(geo.ASN), 10)
+		buf = append(buf, 0)
+		buf = append(buf, geo.Country...)
+	}
 
 	return buf
 }
@@ -280,57 +661,90 @@ func (t t) Client() string {
 	if len(t) < 8 {
 		return ""
 	}
-	return string(t[8:])
+	client, _, _ := strings.Cut(string(t[8:]), "\x00")
+	return client
 }
 
-type blacklistWriter struct {
-	txt *os.File
-	fgz *os.File
-	gw  *gzip.Writer
+func (t t) Geo() Geo {
+	if len(t) < 8 {
+		return Geo{}
+	}
+
+	s := strings.Split(string(t[8:]), "\x00")
+	if len(s) != 3 {
+		return Geo{}
+	}
 
-	bw *bufio.Writer
+	asn, _ := strconv.ParseUint(s[1], 10, 0)
+	return Geo{ASN: uint(asn), Country: s[2]}
 }
 
-func NewBlacklistWriter(path string) (*blacklistWriter, error) {
-	f, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
+// description is the P2P blocklist description of the ban, such as
+// "Xunlei 0019 AS4134 CN".
+func (e entry) description() string {
+	if g := e.geo.String(); g != "" {
+		return strings.TrimSpace(e.client + " " + g)
 	}
+	return e.client
+}
 
-	fgz, err := os.OpenFile(path+".gz", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
+// writeBlocklist writes b to path and gzipped to path.gz, each through a
+// temp file renamed over the old one so a partial list is never served.
+func writeBlocklist(path string, b []byte) error {
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}); err != nil {
+		return err
 	}
 
-	gw := gzip.NewWriter(fgz)
-
-	bw := bufio.NewWriter(io.MultiWriter(f, gw))
-
-	return &blacklistWriter{f, fgz, gw, bw}, nil
+	return writeFileAtomic(path+".gz", func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		if _, err := gw.Write(b); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
 }
 
-func (bw *blacklistWriter) Close() error {
-	if err := bw.bw.Flush(); err != nil {
+// writeFileAtomic writes path with write through a temp file in the same
+// dir, renamed over path once complete.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
 		return err
 	}
+	// a no-op once renamed
+	defer os.Remove(f.Name())
 
-	if err := bw.gw.Close(); err != nil {
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		_ = f.Close()
 		return err
 	}
 
-	if err := bw.fgz.Close(); err != nil {
+	if err := bw.Flush(); err != nil {
+		_ = f.Close()
 		return err
 	}
 
-	if err := bw.txt.Close(); err != nil {
+	if err := f.Chmod(0644); err != nil {
+		_ = f.Close()
 		return err
 	}
 
-	return nil
-}
+	// the data is on disk before the rename, a crash leaves the old or the
+	// new file but never an empty one
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
 
-func (bw *blacklistWriter) Write(p []byte) (int, error) {
-	return bw.bw.Write(p)
+	return os.Rename(f.Name(), path)
 }
 
 type DB struct {
@@ -350,6 +764,10 @@ func NewDB(path string) (*DB, error) {
 	return &DB{db}, nil
 }
 
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
 func (d *DB) addBlock(name ...entry) {
 	err := d.db.Batch(func(tx *bbolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte("blocklist"))
@@ -360,7 +778,7 @@ func (d *DB) addBlock(name ...entry) {
 		nowBytes := uint64(time.Now().Unix())
 
 		for _, v := range name {
-			_ = b.Put([]byte(v.addr), NewT(nowBytes, v.client))
+			_ = b.Put([]byte(v.addr), NewT(nowBytes, v.client, v.geo))
 		}
 
 		return nil
@@ -397,6 +815,7 @@ func (d *DB) rangeBlock(f func(tx *bbolt.Bucket, v entry), expireDuration time.D
 				time:   timeBytes,
 				addr:   string(k),
 				client: t.Client(),
+				geo:    t.Geo(),
 			})
 
 			return nil
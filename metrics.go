@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// counter is a prometheus counter with labels, written in the text
+// exposition format by writeMetrics.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var (
+	metricsMu sync.Mutex
+	counters  []*counter
+)
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+
+	metricsMu.Lock()
+	counters = append(counters, c)
+	metricsMu.Unlock()
+
+	return c
+}
+
+// Add adds n to the series of the label values, in the order of the labels.
+func (c *counter) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[strings.Join(values, "\x00")] += n
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		var ls []string
+		for i, v := range strings.Split(k, "\x00") {
+			if i < len(c.labels) {
+				ls = append(ls, fmt.Sprintf("%s=%q", c.labels[i], v))
+			}
+		}
+
+		if len(ls) == 0 {
+			fmt.Fprintf(w, "%s %v\n", c.name, c.values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", c.name, strings.Join(ls, ","), c.values[k])
+		}
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, c := range counters {
+		c.write(w)
+	}
+}
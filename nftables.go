@@ -116,7 +116,7 @@ func addElement(c *nftables.Conn, addrs []string) error {
 	slog.Info("apply elements", "add", len(addSets), "delete", len(deleteSets))
 
 	table := &nftables.Table{
-		Name:   "transmission-auto-ban",
+		Name:   TABLENAME,
 		Family: nftables.TableFamilyINet,
 	}
 
@@ -415,3 +415,23 @@ func (n *Nftables) SetRuleMap() (map[string]bool, error) {
 
 	return setMap, nil
 }
+
+// nftCleanup deletes the whole table, it is used on shutdown so no stale
+// rules are left behind.
+func nftCleanup() error {
+	c, err := NewNftables()
+	if err != nil {
+		return err
+	}
+	defer c.conn.CloseLasting()
+
+	ok, err := c.TableExist()
+	if err != nil || !ok {
+		return err
+	}
+
+	c.conn.DelTable(c.table)
+	initNftTable = false
+
+	return c.conn.Flush()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	PeerIDStyleAzureus  = "azureus"
+	PeerIDStyleShadow   = "shadow"
+	PeerIDStyleMainline = "mainline"
+	// PeerIDStyleName is a client name already decoded by the torrent
+	// client, such as "qBittorrent 4.6.2"
+	PeerIDStyleName = "name"
+)
+
+// PeerID is a decoded peer id or client name.
+type PeerID struct {
+	Style string
+	// Code is the client code of the peer id, such as "qB" or "XL"
+	Code string
+	// Client is the client name, the code if the client is unknown
+	Client  string
+	Version Version
+	// Prefix is the raw peer id prefix the result was decoded from
+	Prefix string
+}
+
+func (p PeerID) String() string {
+	if len(p.Version) == 0 {
+		return p.Client
+	}
+	return p.Client + " " + p.Version.String()
+}
+
+// azureus style client codes, from
+// https://wiki.theory.org/BitTorrentSpecification#peer_id
+// and the clients list of transmission
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BN": "Baidu Netdisk",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"DL": "Xunlei",
+	"FD": "Free Download Manager",
+	"FG": "FlashGet",
+	"GT": "GT",
+	"HP": "HP",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"NX": "Net Transport",
+	"PI": "PicoTorrent",
+	"QD": "QQDownload",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"SP": "BitSpirit",
+	"TR": "Transmission",
+	"TS": "TorrentStorm",
+	"TT": "TuoTu",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XP": "XPlayer",
+}
+
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+var mainlineClients = map[byte]string{
+	'M': "BitTorrent",
+	'Q': "Queen Bee",
+}
+
+// DecodePeerID decodes the Azureus, Shadow and Mainline peer id styles,
+// unknown ids are returned as they are with PeerIDStyleName.
+func DecodePeerID(id string) PeerID {
+	if p, ok := decodeAzureus(id); ok {
+		return p
+	}
+
+	if p, ok := decodeMainline(id); ok {
+		return p
+	}
+
+	if p, ok := decodeShadow(id); ok {
+		return p
+	}
+
+	return PeerID{Style: PeerIDStyleName, Client: id, Prefix: id}
+}
+
+// DecodeClient decodes a client name reported by the torrent client. Names
+// of unknown clients are the raw peer id prefix, they are decoded as peer
+// ids, others are split into the client name and the version.
+func DecodeClient(name string) PeerID {
+	name = strings.TrimSpace(name)
+
+	if p := DecodePeerID(name); p.Style != PeerIDStyleName {
+		return p
+	}
+
+	// "qBittorrent 4.6.2" or "qBittorrent/4.6.2" of the extension handshake
+	i := strings.LastIndexAny(name, " /")
+	if i == -1 {
+		return PeerID{Style: PeerIDStyleName, Client: name, Prefix: name}
+	}
+
+	v, err := ParseVersion(name[i+1:])
+	if err != nil {
+		return PeerID{Style: PeerIDStyleName, Client: name, Prefix: name}
+	}
+
+	return PeerID{Style: PeerIDStyleName, Client: name[:i], Version: v, Prefix: name}
+}
+
+// -XX1234-
+func decodeAzureus(id string) (PeerID, bool) {
+	if len(id) < 8 || id[0] != '-' || id[7] != '-' {
+		return PeerID{}, false
+	}
+
+	code, ver := id[1:3], id[3:7]
+	if !isAlnum(code) || !isAlnum(ver) {
+		return PeerID{}, false
+	}
+
+	client := azureusClients[code]
+	if client == "" {
+		client = code
+	}
+
+	v := make(Version, 0, 4)
+	for i := range ver {
+		v = append(v, alnumValue(ver[i]))
+	}
+
+	return PeerID{Style: PeerIDStyleAzureus, Code: code, Client: client, Version: v, Prefix: id[:8]}, true
+}
+
+// M7-2-1--
+func decodeMainline(id string) (PeerID, bool) {
+	if len(id) < 4 {
+		return PeerID{}, false
+	}
+
+	client, ok := mainlineClients[id[0]]
+	if !ok {
+		return PeerID{}, false
+	}
+
+	end := strings.Index(id[1:], "--")
+	if end < 1 {
+		return PeerID{}, false
+	}
+
+	var v Version
+	for _, s := range strings.Split(id[1:end+1], "-") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return PeerID{}, false
+		}
+		v = append(v, n)
+	}
+
+	return PeerID{Style: PeerIDStyleMainline, Code: id[:1], Client: client, Version: v, Prefix: id[:end+3]}, true
+}
+
+// S58B-----
+func decodeShadow(id string) (PeerID, bool) {
+	if len(id) < 6 {
+		return PeerID{}, false
+	}
+
+	client, ok := shadowClients[id[0]]
+	if !ok {
+		return PeerID{}, false
+	}
+
+	end := strings.Index(id, "---")
+	if end < 2 || end > 6 {
+		return PeerID{}, false
+	}
+
+	var v Version
+	for i := 1; i < end; i++ {
+		if id[i] == '.' {
+			continue
+		}
+		if !isAlnum(id[i : i+1]) {
+			return PeerID{}, false
+		}
+		v = append(v, shadowValue(id[i]))
+	}
+
+	return PeerID{Style: PeerIDStyleShadow, Code: id[:1], Client: client, Version: v, Prefix: id[:end+3]}, true
+}
+
+func isAlnum(s string) bool {
+	for _, c := range s {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// alnumValue is the azureus version digit, letters are used for 10 and up
+func alnumValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	default:
+		return int(c-'a') + 10
+	}
+}
+
+// shadowValue is the shadow version digit, 0-9, A-Z, a-z, . and -
+func shadowValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	default:
+		return int(c-'a') + 36
+	}
+}
+
+// Version is a dotted version such as 1.53.3, a nil Version is unknown.
+type Version []int
+
+func ParseVersion(s string) (Version, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if s == "" {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	var v Version
+	for _, x := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		v = append(v, n)
+	}
+
+	return v, nil
+}
+
+func (v Version) String() string {
+	if len(v) == 0 {
+		return "unknown"
+	}
+
+	s := make([]string, len(v))
+	for i, x := range v {
+		s[i] = strconv.Itoa(x)
+	}
+	return strings.Join(s, ".")
+}
+
+// Compare compares v and o, missing parts are zero so 1.2 == 1.2.0.
+func (v Version) Compare(o Version) int {
+	for i := range max(len(v), len(o)) {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// ClientRule is a structured client match, such as "anacrolix/torrent <
+// 1.53.3", "qBittorrent == 3.3.15", "XL" or "anacrolix/torrent == unknown".
+type ClientRule struct {
+	Client  string
+	Op      string
+	Version Version
+	raw     string
+}
+
+var clientRuleOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+func ParseClientRule(s string) (ClientRule, error) {
+	s = strings.TrimSpace(s)
+
+	for _, op := range clientRuleOps {
+		i := strings.Index(s, op)
+		if i == -1 {
+			continue
+		}
+
+		client := strings.TrimSpace(s[:i])
+		ver := strings.TrimSpace(s[i+len(op):])
+		if client == "" {
+			return ClientRule{}, fmt.Errorf("invalid client rule %q: no client", s)
+		}
+
+		if ver == "unknown" {
+			if op != "==" && op != "!=" {
+				return ClientRule{}, fmt.Errorf("invalid client rule %q: unknown only supports == and !=", s)
+			}
+			return ClientRule{Client: client, Op: op, raw: s}, nil
+		}
+
+		v, err := ParseVersion(ver)
+		if err != nil {
+			return ClientRule{}, fmt.Errorf("invalid client rule %q: %w", s, err)
+		}
+
+		return ClientRule{Client: client, Op: op, Version: v, raw: s}, nil
+	}
+
+	if s == "" {
+		return ClientRule{}, fmt.Errorf("empty client rule")
+	}
+
+	return ClientRule{Client: s, raw: s}, nil
+}
+
+func (r ClientRule) String() string { return r.raw }
+
+// Match matches the client against the code or the client name of p,
+// "anacrolix" and "anacrolix torrent" both match "anacrolix/torrent".
+func (r ClientRule) Match(p PeerID) bool {
+	if !matchClientName(r.Client, p) {
+		return false
+	}
+
+	switch r.Op {
+	case "":
+		return true
+	case "==":
+		if r.Version == nil {
+			return len(p.Version) == 0
+		}
+		return len(p.Version) > 0 && p.Version.Compare(r.Version) == 0
+	case "!=":
+		if r.Version == nil {
+			return len(p.Version) > 0
+		}
+		return len(p.Version) > 0 && p.Version.Compare(r.Version) != 0
+	}
+
+	// an unknown version is not ordered
+	if len(p.Version) == 0 {
+		return false
+	}
+
+	c := p.Version.Compare(r.Version)
+	switch r.Op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+func matchClientName(name string, p PeerID) bool {
+	if p.Code != "" && name == p.Code {
+		return true
+	}
+
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "/", " "))
+	}
+
+	n, c := normalize(name), normalize(p.Client)
+	return n == c || strings.HasPrefix(c, n+" ")
+}
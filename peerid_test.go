@@ -0,0 +1,108 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestDecodePeerID(t *testing.T) {
+	for _, v := range []struct {
+		id      string
+		style   string
+		client  string
+		version string
+	}{
+		{"-qB4620-abcdefghijkl", PeerIDStyleAzureus, "qBittorrent", "4.6.2.0"},
+		{"-XL0012-", PeerIDStyleAzureus, "Xunlei", "0.0.1.2"},
+		{"-GT0003-", PeerIDStyleAzureus, "GT", "0.0.0.3"},
+		{"-TR400Z-", PeerIDStyleAzureus, "Transmission", "4.0.0.35"},
+		{"M7-2-1--abcdefghijkl", PeerIDStyleMainline, "BitTorrent", "7.2.1"},
+		{"S58B-----abcdefghijk", PeerIDStyleShadow, "Shadow", "5.8.11"},
+		{"T03I--00abcdefghijkl", PeerIDStyleName, "T03I--00abcdefghijkl", "unknown"},
+	} {
+		p := DecodePeerID(v.id)
+		if p.Style != v.style || p.Client != v.client || p.Version.String() != v.version {
+			t.Error(v.id, p.Style, p.Client, p.Version, p.Prefix)
+		}
+	}
+}
+
+func TestClientRule(t *testing.T) {
+	for _, v := range []struct {
+		rule  string
+		name  string
+		match bool
+	}{
+		{"anacrolix/torrent < 1.53.3", "anacrolix/torrent v1.52.0", true},
+		{"anacrolix/torrent < 1.53.3", "anacrolix/torrent v1.53.3", false},
+		{"anacrolix < 1.53.3", "anacrolix/torrent 1.53.2", true},
+		{"anacrolix/torrent == unknown", "anacrolix/torrent unknown", true},
+		{"qBittorrent == 3.3.15", "qBittorrent 3.3.15", true},
+		{"qBittorrent == 3.3.15", "qBittorrent 3.3.16", false},
+		{"qBittorrent >= 4.6", "-qB4620-", true},
+		{"XL", "-XL0012-", true},
+		{"Xunlei", "-XL0012-", true},
+		{"Xunlei", "Transmission 4.0.5", false},
+	} {
+		r, err := ParseClientRule(v.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Match(DecodeClient(v.name)) != v.match {
+			t.Error(v.rule, v.name, DecodeClient(v.name))
+		}
+	}
+}
+
+func TestPeerIDRules(t *testing.T) {
+	var rules []ClientRule
+	for _, v := range peerIDRules {
+		r, err := ParseClientRule(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+
+	// versions that do not parse are not banned
+	for name, match := range map[string]bool{
+		"anacrolix/torrent v1.52.0":                     true,
+		"anacrolix/torrent v1.56.0-beta":                false,
+		"anacrolix/torrent v1.55.1-0.20240101-abcdef12": false,
+		"anacrolix/torrent unknown":                     false,
+		"qBittorrent 3.3.15":                            true,
+	} {
+		matched := slices.ContainsFunc(rules, func(r ClientRule) bool { return r.Match(DecodeClient(name)) })
+		if matched != match {
+			t.Error(name, matched)
+		}
+	}
+}
+
+func TestDefaultDetectorsPeerID(t *testing.T) {
+	ds, err := newDetectors(defaultDetectors().Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each banned version is one hit of the peerid detector, unknown and
+	// pseudo-versions are not banned by any detector
+	for name, want := range map[string][]string{
+		"anacrolix/torrent v1.52.0":                     {"peerid"},
+		"anacrolix/torrent unknown":                     nil,
+		"anacrolix/torrent v1.55.1-0.20240101-abcdef12": nil,
+		"qBittorrent 3.3.15":                            {"peerid"},
+		"qBittorrent 4.6.2":                             nil,
+	} {
+		var got []string
+		for _, h := range detectAll(ds, &transmissionrpc.Torrent{}, &transmissionrpc.Peer{Address: "192.0.2.1", Port: 6881, ClientName: name}) {
+			got = append(got, h.Detector)
+		}
+		if !slices.Equal(got, want) {
+			t.Error(name, got)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+const (
+	PolicyActionStop       = "stop"
+	PolicyActionRemove     = "remove"
+	PolicyActionRemoveData = "remove-data"
+	PolicyActionMove       = "move"
+	PolicyActionLimit      = "limit"
+)
+
+// Policy applies Action to the seeding torrents that match all of the set
+// conditions of Match.
+type Policy struct {
+	Name   string      `yaml:"name"`
+	Match  PolicyMatch `yaml:"match"`
+	Action string      `yaml:"action"`
+	// MoveTo is the new location for the move action
+	MoveTo string `yaml:"move_to,omitempty"`
+	// UploadLimit is the upload limit in KB/s for the limit action
+	UploadLimit int64 `yaml:"upload_limit,omitempty"`
+}
+
+type PolicyMatch struct {
+	// Tracker matches the announce host or any of its parent domains
+	Tracker []string `yaml:"tracker,omitempty"`
+	Label   []string `yaml:"label,omitempty"`
+	Private *bool    `yaml:"private,omitempty"`
+	// DownloadDir matches the download dir or any of its sub directories
+	DownloadDir string        `yaml:"download_dir,omitempty"`
+	MinSize     Size          `yaml:"min_size,omitempty"`
+	MaxSize     Size          `yaml:"max_size,omitempty"`
+	MinAge      time.Duration `yaml:"min_age,omitempty"`
+	MinRatio    float64       `yaml:"min_ratio,omitempty"`
+	MinSeedTime time.Duration `yaml:"min_seed_time,omitempty"`
+	MinIdleTime time.Duration `yaml:"min_idle_time,omitempty"`
+	// PeerASN and PeerCountry match torrents with a connected peer in one
+	// of them, they need geoip databases
+	PeerASN     []uint   `yaml:"peer_asn,omitempty"`
+	PeerCountry []string `yaml:"peer_country,omitempty"`
+}
+
+func (p Policy) Validate() error {
+	var err error
+
+	if p.Name == "" {
+		err = errors.Join(err, errors.New("name: must not be empty"))
+	}
+
+	switch p.Action {
+	case PolicyActionStop, PolicyActionRemove, PolicyActionRemoveData:
+	case PolicyActionMove:
+		if !filepath.IsAbs(p.MoveTo) {
+			err = errors.Join(err, fmt.Errorf("move_to: %q is not an absolute path", p.MoveTo))
+		}
+	case PolicyActionLimit:
+		if p.UploadLimit <= 0 {
+			err = errors.Join(err, errors.New("upload_limit: must be positive"))
+		}
+	default:
+		err = errors.Join(err, fmt.Errorf("action: unknown action %q", p.Action))
+	}
+
+	m := p.Match
+	if len(m.Tracker) == 0 && len(m.Label) == 0 && m.Private == nil && m.DownloadDir == "" &&
+		m.MinSize == 0 && m.MaxSize == 0 && m.MinAge == 0 && m.MinRatio == 0 &&
+		m.MinSeedTime == 0 && m.MinIdleTime == 0 && len(m.PeerASN) == 0 && len(m.PeerCountry) == 0 {
+		err = errors.Join(err, errors.New("match: no condition set"))
+	}
+
+	if m.MinSize < 0 || m.MaxSize < 0 || m.MinAge < 0 || m.MinRatio < 0 ||
+		m.MinSeedTime < 0 || m.MinIdleTime < 0 {
+		err = errors.Join(err, errors.New("match: negative value"))
+	}
+
+	return err
+}
+
+// peerGeoPolicies reports whether a policy of the named instance matches
+// PeerASN or PeerCountry, those read the peers of the idle torrents too.
+func (c *Config) peerGeoPolicies(name string) bool {
+	public, private := c.policies(name)
+	return slices.ContainsFunc(append(slices.Clip(public), private...), func(p Policy) bool {
+		return len(p.Match.PeerASN) > 0 || len(p.Match.PeerCountry) > 0
+	})
+}
+
+// Match reports whether v matches every condition, geo looks up the peers
+// for PeerASN and PeerCountry.
+func (m PolicyMatch) Match(v transmissionrpc.Torrent, geo *GeoDB) bool {
+	if len(m.Tracker) > 0 && !slices.ContainsFunc(trackerHosts(v), func(h string) bool {
+		return slices.ContainsFunc(m.Tracker, func(d string) bool { return matchDomain(h, d) })
+	}) {
+		return false
+	}
+
+	if len(m.Label) > 0 && !slices.ContainsFunc(v.Labels, func(l string) bool { return slices.Contains(m.Label, l) }) {
+		return false
+	}
+
+	if m.Private != nil && (v.IsPrivate == nil || *v.IsPrivate != *m.Private) {
+		return false
+	}
+
+	if m.DownloadDir != "" && (v.DownloadDir == nil || !isSubPath(m.DownloadDir, *v.DownloadDir)) {
+		return false
+	}
+
+	if m.MinSize > 0 && (v.TotalSize == nil || Size(v.TotalSize.Byte()) <= m.MinSize) {
+		return false
+	}
+
+	if m.MaxSize > 0 && (v.TotalSize == nil || Size(v.TotalSize.Byte()) >= m.MaxSize) {
+		return false
+	}
+
+	if m.MinAge > 0 && (v.AddedDate == nil || time.Since(*v.AddedDate) <= m.MinAge) {
+		return false
+	}
+
+	if m.MinRatio > 0 && (v.UploadRatio == nil || *v.UploadRatio < m.MinRatio) {
+		return false
+	}
+
+	if m.MinSeedTime > 0 && (v.TimeSeeding == nil || *v.TimeSeeding < m.MinSeedTime) {
+		return false
+	}
+
+	if m.MinIdleTime > 0 && (v.ActivityDate == nil || time.Since(*v.ActivityDate) < m.MinIdleTime) {
+		return false
+	}
+
+	if (len(m.PeerASN) > 0 || len(m.PeerCountry) > 0) && !geo.matchPeers(v, m.PeerASN, m.PeerCountry) {
+		return false
+	}
+
+	return true
+}
+
+func trackerHosts(v transmissionrpc.Torrent) []string {
+	var hosts []string
+	for _, t := range v.Trackers {
+		u, err := url.Parse(t.Announce)
+		if err != nil {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+// matchDomain reports whether host is domain or a sub domain of it.
+func matchDomain(host, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// applied reports whether the action has no effect on v any more, move and
+// limit keep the torrent seeding so they would match again next run.
+func (p Policy) applied(v transmissionrpc.Torrent) bool {
+	switch p.Action {
+	case PolicyActionMove:
+		return v.DownloadDir != nil && filepath.Clean(*v.DownloadDir) == filepath.Clean(p.MoveTo)
+	case PolicyActionLimit:
+		return v.UploadLimited != nil && *v.UploadLimited && v.UploadLimit != nil && *v.UploadLimit == p.UploadLimit
+	}
+	return false
+}
+
+type PolicyPlan struct {
+	Policy   Policy
+	Torrents []transmissionrpc.Torrent
+}
+
+// planPolicies returns the torrents each policy applies to, a torrent is
+// only taken by the first policy it matches.
+func planPolicies(policies []Policy, torrents []transmissionrpc.Torrent, geo *GeoDB) []PolicyPlan {
+	plans := make([]PolicyPlan, len(policies))
+	for i, p := range policies {
+		plans[i].Policy = p
+	}
+
+	for _, v := range torrents {
+		for i, p := range policies {
+			if !p.Match.Match(v, geo) {
+				continue
+			}
+
+			if !p.applied(v) {
+				plans[i].Torrents = append(plans[i].Torrents, v)
+			}
+			break
+		}
+	}
+
+	return plans
+}
+
+func applyPolicies(ctx context.Context, inst *instance, plans []PolicyPlan) {
+	for _, plan := range plans {
+		if len(plan.Torrents) == 0 {
+			continue
+		}
+
+		p := plan.Policy
+		hashes := torrentHashes(plan.Torrents)
+
+		slog.Info("apply policy", "instance", inst.name, "policy", p.Name, "action", p.Action, "torrents", hashes)
+
+		var err error
+		switch p.Action {
+		case PolicyActionStop:
+			err = inst.cli.StopTorrents(ctx, hashes)
+		case PolicyActionRemove, PolicyActionRemoveData:
+			err = inst.cli.RemoveTorrents(ctx, hashes, p.Action == PolicyActionRemoveData)
+		case PolicyActionMove:
+			err = inst.cli.MoveTorrents(ctx, hashes, p.MoveTo)
+		case PolicyActionLimit:
+			err = inst.cli.LimitTorrents(ctx, hashes, p.UploadLimit)
+		}
+
+		if err != nil {
+			slog.Error("apply policy failed", "instance", inst.name, "policy", p.Name, "err", err)
+		}
+	}
+}
+
+func isSeeding(v transmissionrpc.Torrent) bool {
+	return v.Status != nil && *v.Status == transmissionrpc.TorrentStatusSeed
+}
+
+// policyReport prints what each policy would do to the seeding torrents
+// without applying anything.
+func policyReport(args []string) error {
+	c, err := loadConfig("policy-report", args)
+	if err != nil {
+		return err
+	}
+
+	for _, x := range c.instances() {
+		cli, err := newClient(x)
+		if err != nil {
+			return err
+		}
+
+		at, err := cli.Torrents(context.Background())
+		if err != nil {
+			return fmt.Errorf("%s: %w", x.Name, err)
+		}
+
+		var seeds, privateSeeds []transmissionrpc.Torrent
+		for _, v := range at {
+			if !isSeeding(v) || c.Honeypot.isDecoy(v, nil) {
+				continue
+			}
+
+			if c.Private.IsPrivate(v) {
+				privateSeeds = append(privateSeeds, v)
+			} else {
+				seeds = append(seeds, v)
+			}
+		}
+
+		public, private := c.policies(x.Name)
+
+		fmt.Printf("## %s: public\n", x.Name)
+		writePolicyReport(os.Stdout, planPolicies(public, seeds, c.geo))
+		fmt.Printf("## %s: private\n", x.Name)
+		writePolicyReport(os.Stdout, planPolicies(private, c.Private.seeded(privateSeeds), c.geo))
+	}
+
+	return nil
+}
+
+func writePolicyReport(w io.Writer, plans []PolicyPlan) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	for _, plan := range plans {
+		fmt.Fprintf(tw, "# %s: %s, %d torrents\n", plan.Policy.Name, plan.Policy.Action, len(plan.Torrents))
+
+		for _, v := range plan.Torrents {
+			fmt.Fprintf(tw, "%.8s\t%s\t%s\t%.2f\t%s\n",
+				deref(v.HashString), deref(v.Name), deref(v.TotalSize).GetHumanSizeRepresentation(),
+				deref(v.UploadRatio), time.Since(deref(v.AddedDate)).Truncate(time.Hour))
+		}
+	}
+}
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
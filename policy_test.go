@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestPlanPolicies(t *testing.T) {
+	hash := func(s string) *string { return &s }
+	ratio := func(f float64) *float64 { return &f }
+	added := time.Now().Add(-time.Hour * 24 * 30 * 7)
+	size := cunits.Bits(100 * MiB * 8)
+	private := true
+
+	torrents := []transmissionrpc.Torrent{
+		{HashString: hash("1"), UploadRatio: ratio(3.5)},
+		{HashString: hash("2"), UploadRatio: ratio(0.1), AddedDate: &added, TotalSize: &size},
+		{HashString: hash("3"), UploadRatio: ratio(0.1)},
+		{HashString: hash("4"), UploadRatio: ratio(5), IsPrivate: &private,
+			Trackers: []transmissionrpc.Tracker{{Announce: "https://tracker.example.org/announce"}}},
+	}
+
+	policies := append([]Policy{{
+		Name:   "private",
+		Action: PolicyActionLimit, UploadLimit: 100,
+		Match: PolicyMatch{Tracker: []string{"example.org"}},
+	}}, defaultConfig().Policies...)
+
+	plans := planPolicies(policies, torrents, nil)
+
+	var report bytes.Buffer
+	writePolicyReport(&report, plans)
+	for _, v := range []string{"# private: limit, 1 torrents\n", "# ratio: stop, 1 torrents\n", "# old-small: stop, 1 torrents\n", "\n2 ", "100.00 MiB"} {
+		if !strings.Contains(report.String(), v) {
+			t.Fatal(v, report.String())
+		}
+	}
+
+	if h := torrentHashes(plans[0].Torrents); len(h) != 1 || h[0] != "4" {
+		t.Fatal("private", h)
+	}
+
+	if h := torrentHashes(plans[1].Torrents); len(h) != 1 || h[0] != "1" {
+		t.Fatal("ratio", h)
+	}
+
+	if h := torrentHashes(plans[2].Torrents); len(h) != 1 || h[0] != "2" {
+		t.Fatal("old-small", h)
+	}
+}
+
+func TestPrivateSeeded(t *testing.T) {
+	p := PrivateConfig{
+		MinSeedTime: time.Hour * 72,
+		Trackers:    []PrivateTracker{{Tracker: "pt.example.org", MinSeedTime: time.Hour * 240}},
+	}
+
+	seed := func(d time.Duration, announce string) transmissionrpc.Torrent {
+		return transmissionrpc.Torrent{TimeSeeding: &d, Trackers: []transmissionrpc.Tracker{{Announce: announce}}}
+	}
+
+	torrents := []transmissionrpc.Torrent{
+		seed(time.Hour*100, "https://tracker.pt.example.org/announce"),
+		seed(time.Hour*300, "https://pt.example.org/announce"),
+		seed(time.Hour*100, "https://other.example.com/announce"),
+	}
+
+	if !p.IsPrivate(torrents[0]) || p.IsPrivate(torrents[2]) {
+		t.Fatal("IsPrivate")
+	}
+
+	if got := p.seeded(torrents); len(got) != 2 || *got[0].TimeSeeding != time.Hour*300 {
+		t.Fatal(got)
+	}
+}
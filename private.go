@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// PrivateConfig is the safer policy for private tracker torrents, they are
+// never restarted and no policy is applied before the min seed time of
+// their tracker is reached.
+type PrivateConfig struct {
+	// MinSeedTime is used for trackers without their own min_seed_time
+	MinSeedTime time.Duration `yaml:"min_seed_time"`
+	// Trackers are treated as private even if the torrent is not flagged
+	Trackers  []PrivateTracker `yaml:"trackers"`
+	Policies  []Policy         `yaml:"policies"`
+	Detectors DetectorSets     `yaml:"detectors"`
+}
+
+type PrivateTracker struct {
+	// Tracker matches the announce host or any of its parent domains
+	Tracker     string        `yaml:"tracker"`
+	MinSeedTime time.Duration `yaml:"min_seed_time,omitempty"`
+}
+
+func (p PrivateConfig) Validate() error {
+	var err error
+
+	if p.MinSeedTime < 0 {
+		err = errors.Join(err, errors.New("min_seed_time: negative value"))
+	}
+
+	for i, v := range p.Trackers {
+		if v.Tracker == "" {
+			err = errors.Join(err, fmt.Errorf("trackers[%d]: tracker must not be empty", i))
+		}
+		if v.MinSeedTime < 0 {
+			err = errors.Join(err, fmt.Errorf("trackers[%d]: negative min_seed_time", i))
+		}
+	}
+
+	for i, v := range p.Policies {
+		if er := v.Validate(); er != nil {
+			err = errors.Join(err, fmt.Errorf("policies[%d]: %w", i, er))
+		}
+	}
+
+	if er := p.Detectors.Validate(); er != nil {
+		err = errors.Join(err, fmt.Errorf("detectors.%w", er))
+	}
+
+	return err
+}
+
+func (p PrivateConfig) IsPrivate(v transmissionrpc.Torrent) bool {
+	if v.IsPrivate != nil && *v.IsPrivate {
+		return true
+	}
+
+	hosts := trackerHosts(v)
+	return slices.ContainsFunc(p.Trackers, func(t PrivateTracker) bool {
+		return slices.ContainsFunc(hosts, func(h string) bool { return matchDomain(h, t.Tracker) })
+	})
+}
+
+// MinSeedTimeOf returns the longest min seed time of the trackers of v.
+func (p PrivateConfig) MinSeedTimeOf(v transmissionrpc.Torrent) time.Duration {
+	resp := p.MinSeedTime
+	hosts := trackerHosts(v)
+
+	for _, t := range p.Trackers {
+		if t.MinSeedTime > resp && slices.ContainsFunc(hosts, func(h string) bool { return matchDomain(h, t.Tracker) }) {
+			resp = t.MinSeedTime
+		}
+	}
+
+	return resp
+}
+
+// seeded drops the torrents that did not reach their min seed time.
+func (p PrivateConfig) seeded(torrents []transmissionrpc.Torrent) []transmissionrpc.Torrent {
+	var resp []transmissionrpc.Torrent
+	for _, v := range torrents {
+		if v.TimeSeeding != nil && *v.TimeSeeding >= p.MinSeedTimeOf(v) {
+			resp = append(resp, v)
+		}
+	}
+	return resp
+}
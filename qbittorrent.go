@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/cookiejar"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// qbittorrent is the qBittorrent WebUI API backend, it bans peers with the
+// native ban endpoint.
+type qbittorrent struct {
+	base     *url.URL
+	username string
+	password string
+
+	cli *http.Client
+
+	mu       sync.Mutex
+	loggedIn bool
+	// private caches the flags of WebUIs whose listing lacks it
+	private     map[string]bool
+	warnPrivate sync.Once
+}
+
+func newQBittorrent(u *url.URL, username, password string) (*qbittorrent, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &qbittorrent{
+		base:     u,
+		username: username,
+		password: password,
+		cli:      &http.Client{Jar: jar, Timeout: time.Minute},
+		private:  map[string]bool{},
+	}, nil
+}
+
+type qbTorrent struct {
+	Hash         string  `json:"hash"`
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	State        string  `json:"state"`
+	Ratio        float64 `json:"ratio"`
+	AddedOn      int64   `json:"added_on"`
+	SeedingTime  int64   `json:"seeding_time"`
+	LastActivity int64   `json:"last_activity"`
+	Category     string  `json:"category"`
+	Tags         string  `json:"tags"`
+	SavePath     string  `json:"save_path"`
+	Tracker      string  `json:"tracker"`
+	UpLimit      int64   `json:"up_limit"`
+	Private      *bool   `json:"private"`
+}
+
+type qbPeer struct {
+	IP     string `json:"ip"`
+	Port   int64  `json:"port"`
+	Client string `json:"client"`
+	// PeerIDClient is the start of the raw peer id, such as -qB4620-
+	PeerIDClient string  `json:"peer_id_client"`
+	Progress     float64 `json:"progress"`
+	DLSpeed      int64   `json:"dl_speed"`
+	UPSpeed      int64   `json:"up_speed"`
+	Flags        string  `json:"flags"`
+}
+
+func (q *qbittorrent) Torrents(ctx context.Context) ([]transmissionrpc.Torrent, error) {
+	var ts []qbTorrent
+	if err := q.get(ctx, "torrents/info", nil, &ts); err != nil {
+		return nil, err
+	}
+
+	listed := make(map[string]bool, len(ts))
+	resp := make([]transmissionrpc.Torrent, 0, len(ts))
+	for _, v := range ts {
+		t := v.torrent()
+		listed[v.Hash] = true
+
+		if v.Private == nil {
+			private, err := q.isPrivate(ctx, v.Hash)
+			if err != nil {
+				return nil, err
+			}
+			t.IsPrivate = &private
+		}
+
+		// stopped torrents have no peers
+		t.Peers = []transmissionrpc.Peer{}
+		if *t.Status != transmissionrpc.TorrentStatusStopped {
+			var peers struct {
+				Peers map[string]qbPeer `json:"peers"`
+			}
+			if err := q.get(ctx, "sync/torrentPeers", url.Values{"hash": {v.Hash}, "rid": {"0"}}, &peers); err != nil {
+				return nil, err
+			}
+			for _, p := range peers.Peers {
+				t.Peers = append(t.Peers, p.peer())
+				if p.PeerIDClient != "" {
+					peerIDs.set(p.IP, p.Port, p.PeerIDClient)
+				}
+			}
+		}
+
+		resp = append(resp, t)
+	}
+
+	q.mu.Lock()
+	maps.DeleteFunc(q.private, func(h string, _ bool) bool { return !listed[h] })
+	q.mu.Unlock()
+
+	return resp, nil
+}
+
+// isPrivate reads the flag from the properties of the torrent, for the
+// WebUIs before 5.0 whose listing lacks it. A torrent whose properties lack
+// it too is taken for private so the rules of public torrents never touch it.
+func (q *qbittorrent) isPrivate(ctx context.Context, hash string) (bool, error) {
+	q.mu.Lock()
+	private, ok := q.private[hash]
+	q.mu.Unlock()
+	if ok {
+		return private, nil
+	}
+
+	var props struct {
+		IsPrivate *bool `json:"is_private"`
+	}
+	if err := q.get(ctx, "torrents/properties", url.Values{"hash": {hash}}, &props); err != nil {
+		return false, err
+	}
+
+	private = props.IsPrivate == nil || *props.IsPrivate
+	if props.IsPrivate == nil {
+		q.warnPrivate.Do(func() {
+			slog.Warn("qbittorrent does not report private torrents, they are all taken for private", "url", q.base.Redacted())
+		})
+	}
+
+	q.mu.Lock()
+	q.private[hash] = private
+	q.mu.Unlock()
+
+	return private, nil
+}
+
+var qbStatus = map[string]transmissionrpc.TorrentStatus{
+	"uploading":          transmissionrpc.TorrentStatusSeed,
+	"stalledUP":          transmissionrpc.TorrentStatusSeed,
+	"forcedUP":           transmissionrpc.TorrentStatusSeed,
+	"queuedUP":           transmissionrpc.TorrentStatusSeedWait,
+	"downloading":        transmissionrpc.TorrentStatusDownload,
+	"stalledDL":          transmissionrpc.TorrentStatusDownload,
+	"forcedDL":           transmissionrpc.TorrentStatusDownload,
+	"metaDL":             transmissionrpc.TorrentStatusDownload,
+	"forcedMetaDL":       transmissionrpc.TorrentStatusDownload,
+	"allocating":         transmissionrpc.TorrentStatusDownload,
+	"queuedDL":           transmissionrpc.TorrentStatusDownloadWait,
+	"checkingUP":         transmissionrpc.TorrentStatusCheck,
+	"checkingDL":         transmissionrpc.TorrentStatusCheck,
+	"checkingResumeData": transmissionrpc.TorrentStatusCheck,
+}
+
+func (v qbTorrent) torrent() transmissionrpc.Torrent {
+	status, ok := qbStatus[v.State]
+	if !ok {
+		// paused, stopped, moving, error and missing files
+		status = transmissionrpc.TorrentStatusStopped
+	}
+
+	size := cunits.ImportInByte(float64(v.Size))
+	added := time.Unix(v.AddedOn, 0)
+	activity := time.Unix(v.LastActivity, 0)
+	seeding := time.Duration(v.SeedingTime) * time.Second
+	limited := v.UpLimit > 0
+	limit := v.UpLimit / 1024
+	// WebUIs before 5.0 do not report the flag, Torrents reads it from the
+	// properties then
+	private := v.Private == nil || *v.Private
+
+	t := transmissionrpc.Torrent{
+		HashString:    &v.Hash,
+		Name:          &v.Name,
+		Status:        &status,
+		TotalSize:     &size,
+		UploadRatio:   &v.Ratio,
+		AddedDate:     &added,
+		ActivityDate:  &activity,
+		TimeSeeding:   &seeding,
+		DownloadDir:   &v.SavePath,
+		UploadLimited: &limited,
+		UploadLimit:   &limit,
+		IsPrivate:     &private,
+	}
+
+	if v.Category != "" {
+		t.Labels = append(t.Labels, v.Category)
+	}
+	for _, tag := range strings.Split(v.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			t.Labels = append(t.Labels, tag)
+		}
+	}
+
+	if v.Tracker != "" {
+		t.Trackers = []transmissionrpc.Tracker{{Announce: v.Tracker}}
+	}
+
+	return t
+}
+
+// peer maps the flags of the peer list, D downloading from the peer, d we
+// are interested but choked, U uploading to the peer, u the peer is
+// interested but choked, K the peer unchoked us but we are not interested,
+// ? we unchoked the peer but it is not interested and I incoming.
+func (p qbPeer) peer() transmissionrpc.Peer {
+	has := func(f string) bool { return strings.Contains(p.Flags, f) }
+
+	return transmissionrpc.Peer{
+		Address:            p.IP,
+		Port:               p.Port,
+		ClientName:         p.Client,
+		Progress:           p.Progress,
+		RateToClient:       p.DLSpeed,
+		RateToPeer:         p.UPSpeed,
+		IsDownloadingFrom:  has("D"),
+		IsUploadingTo:      has("U"),
+		ClientIsInterested: has("D") || has("d"),
+		ClientIsChoked:     !has("D") && !has("K"),
+		PeerIsInterested:   has("U") || has("u"),
+		PeerIsChoked:       !has("U") && !has("?"),
+		IsIncoming:         has("I"),
+		FlagStr:            p.Flags,
+	}
+}
+
+// ReloadBlocklist toggles the ip filter, qBittorrent only reloads it when
+// the setting changes. Banned peers are banned natively, the count is not
+// known.
+func (q *qbittorrent) ReloadBlocklist(ctx context.Context) (int64, error) {
+	var prefs struct {
+		IPFilterEnabled bool `json:"ip_filter_enabled"`
+	}
+	if err := q.get(ctx, "app/preferences", nil, &prefs); err != nil {
+		return 0, err
+	}
+
+	if !prefs.IPFilterEnabled {
+		return 0, nil
+	}
+
+	for _, v := range []string{`{"ip_filter_enabled":false}`, `{"ip_filter_enabled":true}`} {
+		if err := q.post(ctx, "app/setPreferences", url.Values{"json": {v}}); err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, nil
+}
+
+// StopTorrents uses the qBittorrent 5 endpoint, then the 4.x one.
+func (q *qbittorrent) StopTorrents(ctx context.Context, hashes []string) error {
+	return q.postFallback(ctx, "torrents/stop", "torrents/pause", url.Values{"hashes": {strings.Join(hashes, "|")}})
+}
+
+func (q *qbittorrent) StartTorrents(ctx context.Context, hashes []string) error {
+	return q.postFallback(ctx, "torrents/start", "torrents/resume", url.Values{"hashes": {strings.Join(hashes, "|")}})
+}
+
+func (q *qbittorrent) BanPeers(ctx context.Context, peers []netip.AddrPort) error {
+	if len(peers) == 0 {
+		return nil
+	}
+
+	s := make([]string, len(peers))
+	for i, v := range peers {
+		s[i] = v.String()
+	}
+
+	return q.post(ctx, "transfer/banPeers", url.Values{"peers": {strings.Join(s, "|")}})
+}
+
+func (q *qbittorrent) RemoveTorrents(ctx context.Context, hashes []string, deleteData bool) error {
+	return q.post(ctx, "torrents/delete", url.Values{
+		"hashes":      {strings.Join(hashes, "|")},
+		"deleteFiles": {strconv.FormatBool(deleteData)},
+	})
+}
+
+func (q *qbittorrent) MoveTorrents(ctx context.Context, hashes []string, dir string) error {
+	return q.post(ctx, "torrents/setLocation", url.Values{"hashes": {strings.Join(hashes, "|")}, "location": {dir}})
+}
+
+func (q *qbittorrent) LimitTorrents(ctx context.Context, hashes []string, limit int64) error {
+	return q.post(ctx, "torrents/setUploadLimit", url.Values{
+		"hashes": {strings.Join(hashes, "|")},
+		"limit":  {strconv.FormatInt(limit*1024, 10)},
+	})
+}
+
+var errQBNotFound = errors.New("not found")
+
+func (q *qbittorrent) postFallback(ctx context.Context, path, fallback string, form url.Values) error {
+	err := q.post(ctx, path, form)
+	if errors.Is(err, errQBNotFound) {
+		return q.post(ctx, fallback, form)
+	}
+	return err
+}
+
+func (q *qbittorrent) get(ctx context.Context, path string, query url.Values, v any) error {
+	b, err := q.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (q *qbittorrent) post(ctx context.Context, path string, form url.Values) error {
+	_, err := q.do(ctx, http.MethodPost, path, nil, form)
+	return err
+}
+
+// do logs in on the first call and again when the session expired.
+func (q *qbittorrent) do(ctx context.Context, method, path string, query, form url.Values) ([]byte, error) {
+	if err := q.login(ctx, false); err != nil {
+		return nil, err
+	}
+
+	b, status, err := q.request(ctx, method, path, query, form)
+	if err == nil && status == http.StatusForbidden {
+		if err := q.login(ctx, true); err != nil {
+			return nil, err
+		}
+		b, status, err = q.request(ctx, method, path, query, form)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case status == http.StatusNotFound:
+		return nil, fmt.Errorf("qbittorrent %s: %w", path, errQBNotFound)
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("qbittorrent %s: %d %s", path, status, strings.TrimSpace(string(b)))
+	}
+
+	return b, nil
+}
+
+func (q *qbittorrent) login(ctx context.Context, force bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// without a username the WebUI is expected to bypass authentication
+	// for this host
+	if (q.loggedIn || q.username == "") && !force {
+		return nil
+	}
+
+	b, status, err := q.request(ctx, http.MethodPost, "auth/login", nil, url.Values{"username": {q.username}, "password": {q.password}})
+	if err != nil {
+		return err
+	}
+
+	// the WebUI answers 200 "Fails." to wrong credentials
+	if status != http.StatusOK || strings.TrimSpace(string(b)) != "Ok." {
+		return fmt.Errorf("qbittorrent login: %d %s", status, strings.TrimSpace(string(b)))
+	}
+
+	q.loggedIn = true
+	return nil
+}
+
+func (q *qbittorrent) request(ctx context.Context, method, path string, query, form url.Values) ([]byte, int, error) {
+	u := q.base.JoinPath("api/v2", path)
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	// the WebUI rejects requests whose referer or origin is another host
+	req.Header.Set("Referer", q.base.Scheme+"://"+q.base.Host)
+
+	resp, err := q.cli.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	return b, resp.StatusCode, err
+}
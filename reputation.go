@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ReputationConfig turns detector matches into a per address score. Each
+// match adds the score of its detector, the score halves every half_life
+// and the address is banned once it reaches threshold.
+type ReputationConfig struct {
+	Threshold float64       `yaml:"threshold"`
+	HalfLife  time.Duration `yaml:"half_life"`
+	// Cooldown is how long the same detector and rule count once for an
+	// address, a peer matching every scan does not add up in minutes
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+func defaultReputation() ReputationConfig {
+	return ReputationConfig{Threshold: 100, HalfLife: time.Hour * 24, Cooldown: time.Hour}
+}
+
+func (r ReputationConfig) Validate() error {
+	var err error
+
+	if r.Threshold <= 0 {
+		err = errors.Join(err, errors.New("threshold: must be positive"))
+	}
+
+	if r.HalfLife < time.Minute {
+		err = errors.Join(err, fmt.Errorf("half_life: %v is less than 1m", r.HalfLife))
+	}
+
+	if r.Cooldown < 0 {
+		err = errors.Join(err, errors.New("cooldown: negative value"))
+	}
+
+	return err
+}
+
+// points is the score of a hit, 0 bans at once.
+func (r ReputationConfig) points(h Hit) float64 {
+	if h.Score == 0 {
+		return r.Threshold
+	}
+	return h.Score
+}
+
+// maxReputationEvents is how many contributing events are kept per address.
+const maxReputationEvents = 32
+
+type Reputation struct {
+	Addr    string            `json:"addr"`
+	Score   float64           `json:"score"`
+	Updated time.Time         `json:"updated"`
+	Events  []ReputationEvent `json:"events"`
+}
+
+type ReputationEvent struct {
+	Time     time.Time `json:"time"`
+	Detector string    `json:"detector"`
+	Rule     string    `json:"rule"`
+	Client   string    `json:"client"`
+	Torrent  string    `json:"torrent"`
+	Points   float64   `json:"points"`
+}
+
+// decay brings the score to now.
+func (r *Reputation) decay(now time.Time, halfLife time.Duration) {
+	if !r.Updated.IsZero() && now.After(r.Updated) {
+		r.Score *= math.Pow(0.5, float64(now.Sub(r.Updated))/float64(halfLife))
+	}
+	r.Updated = now
+}
+
+// add adds e unless the same detector and rule were counted within
+// cooldown, it reports whether e was added.
+func (r *Reputation) add(e ReputationEvent, cooldown time.Duration) bool {
+	for _, v := range r.Events {
+		if v.Detector == e.Detector && v.Rule == e.Rule && e.Time.Sub(v.Time) < cooldown {
+			return false
+		}
+	}
+
+	r.Score += e.Points
+	r.Events = append(r.Events, e)
+	if len(r.Events) > maxReputationEvents {
+		r.Events = r.Events[len(r.Events)-maxReputationEvents:]
+	}
+
+	return true
+}
+
+// Client is the client name of the latest event.
+func (r *Reputation) Client() string {
+	if len(r.Events) == 0 {
+		return ""
+	}
+	return r.Events[len(r.Events)-1].Client
+}
+
+var reputationBucket = []byte("reputation")
+
+// score adds the events of each address to its reputation and returns the
+// addresses that reached the threshold. Decayed addresses are dropped.
+func (d *DB) score(c ReputationConfig, events map[string][]ReputationEvent) []Reputation {
+	var resp []Reputation
+
+	err := d.db.Batch(func(tx *bbolt.Tx) error {
+		resp = nil
+
+		b, err := tx.CreateBucketIfNotExists(reputationBucket)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		for addr, es := range events {
+			r := Reputation{Addr: addr}
+			if v := b.Get([]byte(addr)); v != nil {
+				if err := json.Unmarshal(v, &r); err != nil {
+					slog.Error("reputation", "address", addr, "err", err)
+				}
+			}
+
+			r.decay(now, c.HalfLife)
+
+			changed := false
+			for _, e := range es {
+				changed = r.add(e, c.Cooldown) || changed
+			}
+
+			if changed {
+				buf, err := json.Marshal(r)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(addr), buf); err != nil {
+					return err
+				}
+			}
+
+			if r.Score >= c.Threshold {
+				resp = append(resp, r)
+			}
+		}
+
+		return pruneReputation(b, now, c.HalfLife)
+	})
+	if err != nil {
+		slog.Error("score", "err", err)
+	}
+
+	return resp
+}
+
+// pruneReputation drops the addresses whose score decayed below one point.
+func pruneReputation(b *bbolt.Bucket, now time.Time, halfLife time.Duration) error {
+	var keys [][]byte
+
+	err := b.ForEach(func(k, v []byte) error {
+		var r Reputation
+		if err := json.Unmarshal(v, &r); err != nil {
+			keys = append(keys, k)
+			return nil
+		}
+
+		r.decay(now, halfLife)
+		if r.Score < 1 {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rangeReputation calls f with every reputation decayed to now.
+func (d *DB) rangeReputation(halfLife time.Duration, f func(r Reputation)) error {
+	now := time.Now()
+
+	return d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(reputationBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var r Reputation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return nil
+			}
+
+			r.decay(now, halfLife)
+			f(r)
+			return nil
+		})
+	})
+}
+
+// reputation returns the reputation of addr decayed to now.
+func (d *DB) reputation(halfLife time.Duration, addr string) (Reputation, bool, error) {
+	var (
+		r  Reputation
+		ok bool
+	)
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(reputationBucket)
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(addr))
+		if v == nil {
+			return nil
+		}
+
+		ok = true
+		return json.Unmarshal(v, &r)
+	})
+	if err != nil || !ok {
+		return r, ok, err
+	}
+
+	r.decay(time.Now(), halfLife)
+	return r, true, nil
+}
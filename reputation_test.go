@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+	now := time.Now()
+	r := Reputation{Score: 80, Updated: now.Add(-time.Hour * 24)}
+
+	r.decay(now, time.Hour*24)
+	if math.Abs(r.Score-40) > 0.01 {
+		t.Fatal(r.Score)
+	}
+
+	if r.add(ReputationEvent{Time: now, Detector: "spoof", Rule: "no-progress", Points: 50}, time.Hour) != true {
+		t.Fatal("first event not added")
+	}
+	// the same rule within the cooldown counts once
+	if r.add(ReputationEvent{Time: now.Add(time.Minute), Detector: "spoof", Rule: "no-progress", Points: 50}, time.Hour) {
+		t.Fatal("event added within cooldown")
+	}
+	if math.Abs(r.Score-90) > 0.01 {
+		t.Fatal(r.Score)
+	}
+}
+
+func TestScore(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := defaultReputation()
+	now := time.Now()
+
+	weak := func(detector string) ReputationEvent {
+		return ReputationEvent{Time: now, Detector: detector, Rule: detector, Client: "qBittorrent 4.6.2", Points: 40}
+	}
+
+	banned := db.score(c, map[string][]ReputationEvent{"1.2.3.4": {weak("spoof")}})
+	if len(banned) != 0 {
+		t.Fatal(banned)
+	}
+
+	// weak signals of different detectors add up
+	banned = db.score(c, map[string][]ReputationEvent{"1.2.3.4": {weak("choke"), weak("feed")}})
+	if len(banned) != 1 || banned[0].Addr != "1.2.3.4" || len(banned[0].Events) != 3 {
+		t.Fatal(banned)
+	}
+
+	r, ok, err := db.reputation(c.HalfLife, "1.2.3.4")
+	if err != nil || !ok || r.Score < 119 {
+		t.Fatal(r, ok, err)
+	}
+	t.Log(r)
+}
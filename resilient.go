@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+type RetryConfig struct {
+	// Timeout bounds each attempt of a call
+	Timeout  time.Duration `yaml:"timeout"`
+	Attempts int           `yaml:"attempts"`
+	// Backoff is the wait after the first failed attempt, it doubles up to
+	// MaxBackoff, the actual wait is jittered between half and all of it
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// BreakerFailures failed calls in a row open the circuit, calls fail
+	// at once until BreakerCooldown passed, then one call probes the client
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+}
+
+func defaultRetry() RetryConfig {
+	return RetryConfig{
+		Timeout:         time.Second * 30,
+		Attempts:        3,
+		Backoff:         time.Second,
+		MaxBackoff:      time.Second * 30,
+		BreakerFailures: 5,
+		BreakerCooldown: time.Minute,
+	}
+}
+
+func (r RetryConfig) Validate() error {
+	var err error
+
+	if r.Timeout <= 0 {
+		err = errors.Join(err, fmt.Errorf("timeout: %v must be positive", r.Timeout))
+	}
+	if r.Attempts < 1 {
+		err = errors.Join(err, fmt.Errorf("attempts: %d is less than 1", r.Attempts))
+	}
+	if r.Backoff < 0 || r.MaxBackoff < r.Backoff {
+		err = errors.Join(err, fmt.Errorf("backoff: %v is negative or above max_backoff %v", r.Backoff, r.MaxBackoff))
+	}
+	if r.BreakerFailures < 1 {
+		err = errors.Join(err, fmt.Errorf("breaker_failures: %d is less than 1", r.BreakerFailures))
+	}
+	if r.BreakerCooldown <= 0 {
+		err = errors.Join(err, fmt.Errorf("breaker_cooldown: %v must be positive", r.BreakerCooldown))
+	}
+
+	return err
+}
+
+// backoff is the jittered wait after the failed attempt, 0 based.
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	d := r.Backoff
+	for range attempt {
+		if d *= 2; d >= r.MaxBackoff {
+			d = r.MaxBackoff
+			break
+		}
+	}
+
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// ClientHealth is the health of the connection to a client.
+type ClientHealth struct {
+	// Breaker is closed while calls succeed
+	Breaker  string `json:"breaker"`
+	Failures int    `json:"failures"`
+
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+func (h ClientHealth) Healthy() bool { return h.Breaker == BreakerClosed }
+
+var rpcErrors = newCounter("tban_rpc_errors_total", "Failed torrent client calls, after retries.", "instance", "method")
+
+// resilientClient wraps a client with per call timeouts, retries and a
+// circuit breaker. The settings are read from the current config on every
+// call.
+type resilientClient struct {
+	name string
+	cli  TorrentClient
+
+	mu      sync.Mutex
+	health  ClientHealth
+	opened  time.Time
+	probing bool
+}
+
+func newResilientClient(name string, cli TorrentClient) *resilientClient {
+	return &resilientClient{name: name, cli: cli, health: ClientHealth{Breaker: BreakerClosed}}
+}
+
+func (r *resilientClient) Health() ClientHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.health
+}
+
+// allow reports whether a call may go through, after the cooldown one call
+// at a time probes the client.
+func (r *resilientClient) allow(c RetryConfig) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.health.Breaker {
+	case BreakerOpen:
+		if time.Since(r.opened) < c.BreakerCooldown {
+			return false
+		}
+		r.health.Breaker = BreakerHalfOpen
+		r.probing = true
+		return true
+	case BreakerHalfOpen:
+		if r.probing {
+			return false
+		}
+		r.probing = true
+	}
+
+	return true
+}
+
+func (r *resilientClient) done(c RetryConfig, method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.probing = false
+
+	if err == nil {
+		if r.health.Breaker != BreakerClosed {
+			slog.Info("circuit breaker closed", "instance", r.name)
+		}
+		r.health.Breaker = BreakerClosed
+		r.health.Failures = 0
+		r.health.LastSuccess = time.Now()
+		return
+	}
+
+	rpcErrors.Add(1, r.name, method)
+
+	r.health.Failures++
+	r.health.LastFailure = time.Now()
+	r.health.LastError = err.Error()
+
+	if r.health.Breaker == BreakerHalfOpen || (r.health.Breaker == BreakerClosed && r.health.Failures >= c.BreakerFailures) {
+		if r.health.Breaker == BreakerClosed {
+			slog.Warn("circuit breaker open", "instance", r.name, "failures", r.health.Failures, "err", err)
+		}
+		r.health.Breaker = BreakerOpen
+		r.opened = time.Now()
+	}
+}
+
+// call runs f with retries, a canceled ctx and an open breaker are not
+// retried.
+func (r *resilientClient) call(ctx context.Context, method string, f func(ctx context.Context) error) error {
+	c := conf().Retry
+
+	if !r.allow(c) {
+		return fmt.Errorf("%s: %w", method, errBreakerOpen)
+	}
+
+	var err error
+	for i := range c.Attempts {
+		if i > 0 {
+			d := c.backoff(i - 1)
+			slog.Debug("retry", "instance", r.name, "method", method, "after", d, "err", err)
+
+			select {
+			case <-ctx.Done():
+				err = errors.Join(err, ctx.Err())
+				r.done(c, method, err)
+				return err
+			case <-time.After(d):
+			}
+		}
+
+		actx, cancel := context.WithTimeout(ctx, c.Timeout)
+		err = f(actx)
+		cancel()
+
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	r.done(c, method, err)
+	return err
+}
+
+// callOnce runs f without retries, for the calls that may have taken effect
+// although they timed out, such as a remove with the data or a move.
+func (r *resilientClient) callOnce(ctx context.Context, method string, f func(ctx context.Context) error) error {
+	c := conf().Retry
+	if !r.allow(c) {
+		return fmt.Errorf("%s: %w", method, errBreakerOpen)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	err := f(ctx)
+	r.done(c, method, err)
+	return err
+}
+
+func (r *resilientClient) Torrents(ctx context.Context) (resp []transmissionrpc.Torrent, err error) {
+	err = r.call(ctx, "Torrents", func(ctx context.Context) error {
+		resp, err = r.cli.Torrents(ctx)
+		return err
+	})
+	return resp, err
+}
+
+func (r *resilientClient) ReloadBlocklist(ctx context.Context) (n int64, err error) {
+	err = r.call(ctx, "ReloadBlocklist", func(ctx context.Context) error {
+		n, err = r.cli.ReloadBlocklist(ctx)
+		return err
+	})
+	return n, err
+}
+
+func (r *resilientClient) StopTorrents(ctx context.Context, hashes []string) error {
+	return r.call(ctx, "StopTorrents", func(ctx context.Context) error { return r.cli.StopTorrents(ctx, hashes) })
+}
+
+func (r *resilientClient) StartTorrents(ctx context.Context, hashes []string) error {
+	return r.call(ctx, "StartTorrents", func(ctx context.Context) error { return r.cli.StartTorrents(ctx, hashes) })
+}
+
+func (r *resilientClient) BanPeers(ctx context.Context, peers []netip.AddrPort) error {
+	return r.call(ctx, "BanPeers", func(ctx context.Context) error { return r.cli.BanPeers(ctx, peers) })
+}
+
+// RemoveTorrents is not retried, the data may be gone already.
+func (r *resilientClient) RemoveTorrents(ctx context.Context, hashes []string, deleteData bool) error {
+	return r.callOnce(ctx, "RemoveTorrents", func(ctx context.Context) error { return r.cli.RemoveTorrents(ctx, hashes, deleteData) })
+}
+
+// MoveTorrents is not retried, a second move would run alongside the first.
+func (r *resilientClient) MoveTorrents(ctx context.Context, hashes []string, dir string) error {
+	return r.callOnce(ctx, "MoveTorrents", func(ctx context.Context) error { return r.cli.MoveTorrents(ctx, hashes, dir) })
+}
+
+func (r *resilientClient) LimitTorrents(ctx context.Context, hashes []string, limit int64) error {
+	return r.call(ctx, "LimitTorrents", func(ctx context.Context) error { return r.cli.LimitTorrents(ctx, hashes, limit) })
+}
+
+// AddTorrent is not retried, a retry after a timeout could add the decoy
+// twice.
+func (r *resilientClient) AddTorrent(ctx context.Context, metainfo []byte, dir string, labels []string) error {
+	dc, ok := r.cli.(DecoyClient)
+	if !ok {
+		return errors.New("the client does not support decoys")
+	}
+
+	return r.callOnce(ctx, "AddTorrent", func(ctx context.Context) error { return dc.AddTorrent(ctx, metainfo, dir, labels) })
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// withRetry makes r the retry config of the test.
+func withRetry(t *testing.T, r RetryConfig) {
+	c := *conf()
+	c.Retry = r
+	old := config.Swap(&c)
+	t.Cleanup(func() { config.Store(old) })
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := defaultRetry()
+
+	for i, want := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 30, time.Second * 30} {
+		if d := r.backoff([]int{0, 1, 2, 5, 100}[i]); d < want/2 || d > want {
+			t.Fatal(i, d)
+		}
+	}
+}
+
+func TestResilientClient(t *testing.T) {
+	withRetry(t, RetryConfig{
+		Timeout: time.Second, Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond,
+		BreakerFailures: 2, BreakerCooldown: time.Millisecond * 50,
+	})
+
+	f := &fakeClient{err: errors.New("connection refused")}
+	r := newResilientClient("a", f)
+	ctx := context.Background()
+
+	// every call is tried 3 times, the second failed call opens the breaker
+	for range 2 {
+		if err := r.StartTorrents(ctx, []string{"aa"}); err == nil {
+			t.Fatal("expect error")
+		}
+	}
+	if len(f.started) != 6 || r.Health().Breaker != BreakerOpen || r.Health().Failures != 2 {
+		t.Fatal(len(f.started), r.Health())
+	}
+
+	if err := r.StartTorrents(ctx, []string{"aa"}); !errors.Is(err, errBreakerOpen) || len(f.started) != 6 {
+		t.Fatal(err, len(f.started))
+	}
+
+	// the probe after the cooldown closes it
+	time.Sleep(time.Millisecond * 60)
+	f.err = nil
+	if err := r.StartTorrents(ctx, []string{"aa"}); err != nil {
+		t.Fatal(err)
+	}
+	if h := r.Health(); !h.Healthy() || h.Failures != 0 || h.LastError == "" {
+		t.Fatal(h)
+	}
+
+	// a remove may have deleted the data before it timed out, it is not
+	// retried
+	f.err = errors.New("timeout")
+	if err := r.RemoveTorrents(ctx, []string{"aa"}, true); err == nil || f.removes != 1 {
+		t.Fatal(err, f.removes)
+	}
+}
+
+func TestReconcileRestarts(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "blocklist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	f := &fakeClient{err: errors.New("connection refused")}
+	inst := &instance{name: "a", cli: f}
+	tban := &TBan{db: db}
+
+	// ctx is done, the start follows the stop at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tban.restartTorrents(ctx, inst, []string{"aa", "bb"})
+	if pending, _ := db.restarts("a"); len(pending) != 2 {
+		t.Fatal(pending)
+	}
+
+	// bb was removed meanwhile
+	f.err = nil
+	f.started = nil
+	tban.reconcileRestarts(context.Background(), conf(), inst, []transmissionrpc.Torrent{fakeTorrent("aa", false)})
+
+	if pending, _ := db.restarts("a"); len(pending) != 0 || !slices.Equal(f.started, []string{"aa"}) {
+		t.Fatal(pending, f.started)
+	}
+
+	// a stop policy would stop cc again, it is left stopped
+	c := *conf()
+	c.Policies = []Policy{{Name: "stop", Action: PolicyActionStop, Match: PolicyMatch{Label: []string{"done"}}}}
+	cc := fakeTorrent("cc", false)
+	cc.Labels = []string{"done"}
+
+	if err := db.putRestarts("a", []string{"cc"}); err != nil {
+		t.Fatal(err)
+	}
+	f.started = nil
+	tban.reconcileRestarts(context.Background(), &c, inst, []transmissionrpc.Torrent{cc})
+
+	if pending, _ := db.restarts("a"); len(pending) != 0 || len(f.started) != 0 {
+		t.Fatal(pending, f.started)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+	"go.etcd.io/bbolt"
+)
+
+// restartDelay is the time the client gets to close the connections of the
+// stopped torrents.
+const restartDelay = time.Second * 3
+
+var restartBucket = []byte("restart")
+
+// restartTorrents stops the torrents to drop the connections of banned
+// peers and starts them again. The torrents are recorded before the stop, a
+// start that still fails after the retries is done by reconcileRestarts on
+// the next run.
+func (t *TBan) restartTorrents(ctx context.Context, inst *instance, torrents []string) {
+	if len(torrents) == 0 {
+		return
+	}
+
+	if err := t.db.putRestarts(inst.name, torrents); err != nil {
+		slog.Error("restart torrents", "instance", inst.name, "err", err)
+		return
+	}
+
+	slog.Info("restart torrents", "instance", inst.name, "torrents", torrents)
+
+	// a failed stop may still have stopped some of them, start all
+	if err := inst.cli.StopTorrents(ctx, torrents); err != nil {
+		slog.Error("StopTorrents failed", "instance", inst.name, "err", err)
+	}
+
+	// the torrents are stopped already, start them even if ctx is done
+	select {
+	case <-ctx.Done():
+	case <-time.After(restartDelay):
+	}
+
+	t.startTorrents(context.WithoutCancel(ctx), inst, torrents)
+}
+
+func (t *TBan) startTorrents(ctx context.Context, inst *instance, torrents []string) {
+	if err := inst.cli.StartTorrents(ctx, torrents); err != nil {
+		slog.Error("StartTorrents failed, retried next run", "instance", inst.name, "err", err, "torrents", torrents)
+		return
+	}
+
+	if err := t.db.deleteRestarts(inst.name, torrents); err != nil {
+		slog.Error("restart torrents", "instance", inst.name, "err", err)
+	}
+}
+
+// reconcileRestarts starts the torrents of inst a previous run stopped but
+// could not start again, at is the current listing. Torrents a stop or
+// remove policy of c matches are left stopped.
+func (t *TBan) reconcileRestarts(ctx context.Context, c *Config, inst *instance, at []transmissionrpc.Torrent) {
+	pending, err := t.db.restarts(inst.name)
+	if err != nil {
+		slog.Error("restart torrents", "instance", inst.name, "err", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	present := map[string]transmissionrpc.Torrent{}
+	for _, v := range at {
+		if v.HashString != nil {
+			present[*v.HashString] = v
+		}
+	}
+
+	var start, gone []string
+	for _, v := range pending {
+		x, ok := present[v]
+		switch {
+		case !ok:
+			gone = append(gone, v)
+		case stoppedByPolicy(c, inst.name, x):
+			slog.Info("torrent left stopped by policy", "instance", inst.name, "torrent", v)
+			gone = append(gone, v)
+		default:
+			start = append(start, v)
+		}
+	}
+
+	if len(gone) > 0 {
+		if err := t.db.deleteRestarts(inst.name, gone); err != nil {
+			slog.Error("restart torrents", "instance", inst.name, "err", err)
+		}
+	}
+
+	if len(start) > 0 {
+		slog.Info("start torrents left stopped", "instance", inst.name, "torrents", start)
+		t.startTorrents(ctx, inst, start)
+	}
+}
+
+// stoppedByPolicy reports whether the first policy of the instance that
+// matches v stops or removes it, the run would stop it again right away.
+func stoppedByPolicy(c *Config, name string, v transmissionrpc.Torrent) bool {
+	policies, private := c.policies(name)
+	if c.Private.IsPrivate(v) {
+		if len(c.Private.seeded([]transmissionrpc.Torrent{v})) == 0 {
+			return false
+		}
+		policies = private
+	}
+
+	i := slices.IndexFunc(policies, func(p Policy) bool { return p.Match.Match(v, c.geo) })
+	if i < 0 {
+		return false
+	}
+
+	switch policies[i].Action {
+	case PolicyActionStop, PolicyActionRemove, PolicyActionRemoveData:
+		return true
+	}
+	return false
+}
+
+// putRestarts records the torrents of the instance as stopped for a
+// restart, keyed by hash with the unix time.
+func (d *DB) putRestarts(name string, hashes []string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(restartBucket)
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+
+		now := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+		for _, v := range hashes {
+			if err := b.Put([]byte(v), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *DB) deleteRestarts(name string, hashes []string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(restartBucket)
+		if b == nil {
+			return nil
+		}
+		if b = b.Bucket([]byte(name)); b == nil {
+			return nil
+		}
+
+		for _, v := range hashes {
+			if err := b.Delete([]byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *DB) restarts(name string) ([]string, error) {
+	var resp []string
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(restartBucket)
+		if b == nil {
+			return nil
+		}
+		if b = b.Bucket([]byte(name)); b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, _ []byte) error {
+			resp = append(resp, string(k))
+			return nil
+		})
+	})
+
+	return resp, err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// RuleStats tells whether a rule still earns its keep. Hits counts every
+// match of every scan, IPs and Clients are the distinct ones matched within
+// ruleSetWindow, at most ruleSetMax of each.
+type RuleStats struct {
+	Detector string    `json:"detector"`
+	Rule     string    `json:"rule"`
+	Hits     uint64    `json:"hits"`
+	LastHit  time.Time `json:"last_hit"`
+	IPs      int       `json:"ips"`
+	Clients  int       `json:"clients"`
+}
+
+// ruleHit is one match of a scan.
+type ruleHit struct {
+	detector, rule string
+	addr, client   string
+}
+
+// ruleLister is implemented by the detectors with a fixed rule list, their
+// rules are reported even if they never matched.
+type ruleLister interface {
+	Rules() []string
+}
+
+var ruleHitsTotal = newCounter("tban_rule_hits_total", "Matches of each detector rule.", "detector", "rule")
+
+// The address and client sets of a rule keep the entries seen within the
+// window, the most recent ones up to the max. The feed detector matches
+// every address of the feeds, the sets would grow with them otherwise.
+const (
+	ruleSetWindow = 30 * 24 * time.Hour
+	ruleSetMax    = 1000
+)
+
+var (
+	rulesBucket   = []byte("rules")
+	ruleHitsKey   = []byte("hits")
+	ruleLastKey   = []byte("last")
+	ruleIPsKey    = []byte("ips")
+	ruleClientKey = []byte("clients")
+)
+
+// recordHits adds the matches of a scan to the stats of their rules. Each
+// rule is a bucket keyed detector \0 rule, holding the hit count, the unix
+// time of the last hit and the sets of addresses and clients, each mapped
+// to the unix time it was last seen.
+func (d *DB) recordHits(hits []ruleHit) {
+	if len(hits) == 0 {
+		return
+	}
+
+	for _, v := range hits {
+		ruleHitsTotal.Add(1, v.detector, v.rule)
+	}
+
+	err := d.db.Batch(func(tx *bbolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(rulesBucket)
+		if err != nil {
+			return err
+		}
+
+		now := make([]byte, 8)
+		binary.BigEndian.PutUint64(now, uint64(time.Now().Unix()))
+
+		touched := map[*bbolt.Bucket]bool{}
+		for _, v := range hits {
+			b, err := root.CreateBucketIfNotExists([]byte(v.detector + "\x00" + v.rule))
+			if err != nil {
+				return err
+			}
+
+			n := make([]byte, 8)
+			if old := b.Get(ruleHitsKey); len(old) == 8 {
+				binary.BigEndian.PutUint64(n, binary.BigEndian.Uint64(old)+1)
+			} else {
+				binary.BigEndian.PutUint64(n, 1)
+			}
+			if err := b.Put(ruleHitsKey, n); err != nil {
+				return err
+			}
+			if err := b.Put(ruleLastKey, now); err != nil {
+				return err
+			}
+
+			for _, set := range []struct{ key, value []byte }{{ruleIPsKey, []byte(v.addr)}, {ruleClientKey, []byte(v.client)}} {
+				if len(set.value) == 0 {
+					continue
+				}
+				s, err := b.CreateBucketIfNotExists(set.key)
+				if err != nil {
+					return err
+				}
+				if err := s.Put(set.value, now); err != nil {
+					return err
+				}
+				touched[s] = true
+			}
+		}
+
+		for s := range touched {
+			if err := trimRuleSet(s, time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("recordHits", "err", err)
+	}
+}
+
+// trimRuleSet drops the entries of s last seen before the window, and the
+// oldest ones over ruleSetMax. Entries of older versions carry no time and
+// go first.
+func trimRuleSet(s *bbolt.Bucket, now time.Time) error {
+	type item struct {
+		key  []byte
+		seen uint64
+	}
+
+	cutoff := uint64(now.Add(-ruleSetWindow).Unix())
+	var keep, drop []item
+	err := s.ForEach(func(k, v []byte) error {
+		it := item{key: slices.Clone(k)}
+		if len(v) == 8 {
+			it.seen = binary.BigEndian.Uint64(v)
+		}
+		if it.seen < cutoff {
+			drop = append(drop, it)
+		} else {
+			keep = append(keep, it)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(keep) > ruleSetMax {
+		slices.SortFunc(keep, func(a, b item) int { return cmp.Compare(a.seen, b.seen) })
+		drop = append(drop, keep[:len(keep)-ruleSetMax]...)
+	}
+
+	for _, v := range drop {
+		if err := s.Delete(v.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ruleStats returns the stats of every rule that matched, and of the rules
+// of ds that never did.
+func (d *DB) ruleStats(ds ...map[string][]Detector) ([]RuleStats, error) {
+	var resp []RuleStats
+	seen := map[string]bool{}
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		root := tx.Bucket(rulesBucket)
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(k, _ []byte) error {
+			b := root.Bucket(k)
+			if b == nil {
+				return nil
+			}
+
+			detector, rule, _ := strings.Cut(string(k), "\x00")
+			s := RuleStats{Detector: detector, Rule: rule}
+
+			if v := b.Get(ruleHitsKey); len(v) == 8 {
+				s.Hits = binary.BigEndian.Uint64(v)
+			}
+			if v := b.Get(ruleLastKey); len(v) == 8 {
+				s.LastHit = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			}
+			if v := b.Bucket(ruleIPsKey); v != nil {
+				s.IPs = v.Stats().KeyN
+			}
+			if v := b.Bucket(ruleClientKey); v != nil {
+				s.Clients = v.Stats().KeyN
+			}
+
+			seen[string(k)] = true
+			resp = append(resp, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range ds {
+		for _, group := range set {
+			for _, v := range group {
+				if c, ok := v.(*configuredDetector); ok {
+					v = c.Detector
+				}
+
+				l, ok := v.(ruleLister)
+				if !ok {
+					continue
+				}
+
+				for _, r := range l.Rules() {
+					k := v.Name() + "\x00" + r
+					if !seen[k] {
+						seen[k] = true
+						resp = append(resp, RuleStats{Detector: v.Name(), Rule: r})
+					}
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(resp, func(a, b RuleStats) int {
+		if c := strings.Compare(a.Detector, b.Detector); c != 0 {
+			return c
+		}
+		switch {
+		case a.Hits > b.Hits:
+			return -1
+		case a.Hits < b.Hits:
+			return 1
+		}
+		return strings.Compare(a.Rule, b.Rule)
+	})
+
+	return resp, nil
+}
+
+// ruleStatsReport prints the hit stats of every rule, it asks the running
+// daemon as the db is locked.
+func ruleStatsReport(args []string) error {
+	c, err := loadConfig("rule-stats", args)
+	if err != nil {
+		return err
+	}
+
+	var stats []RuleStats
+	if err := apiGet(c, "/api/rules", &stats); err != nil {
+		return err
+	}
+
+	writeRuleStats(os.Stdout, stats)
+	return nil
+}
+
+func writeRuleStats(w io.Writer, stats []RuleStats) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintln(tw, "DETECTOR\tRULE\tHITS\tIPS\tCLIENTS\tLAST HIT")
+	for _, v := range stats {
+		last := "never"
+		if !v.LastHit.IsZero() {
+			last = v.LastHit.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\n", v.Detector, v.Rule, v.Hits, v.IPs, v.Clients, last)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRuleStats(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.recordHits([]ruleHit{
+		{"client", "xunlei", "1.2.3.4", "xunlei 0001"},
+		{"client", "xunlei", "1.2.3.4", "xunlei 0002"},
+	})
+	db.recordHits([]ruleHit{{"client", "xunlei", "5.6.7.8", "xunlei 0001"}})
+
+	ds, err := defaultDetectors().New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.ruleStats(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xunlei, taipei *RuleStats
+	for i, v := range stats {
+		switch {
+		case v.Detector == "client" && v.Rule == "xunlei":
+			xunlei = &stats[i]
+		case v.Detector == "client" && v.Rule == "Taipei-Torrent dev":
+			taipei = &stats[i]
+		}
+	}
+
+	if xunlei == nil || xunlei.Hits != 3 || xunlei.IPs != 2 || xunlei.Clients != 2 || xunlei.LastHit.IsZero() {
+		t.Fatal(xunlei)
+	}
+
+	// the sets are capped, the feed detector matches every feed address
+	var feed []ruleHit
+	for i := range ruleSetMax + 10 {
+		feed = append(feed, ruleHit{"feed", "feed", fmt.Sprintf("10.0.%d.%d", i/256, i%256), ""})
+	}
+	db.recordHits(feed)
+
+	stats, err = db.ruleStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.IndexFunc(stats, func(v RuleStats) bool { return v.Detector == "feed" }); i < 0 || stats[i].Hits != ruleSetMax+10 || stats[i].IPs != ruleSetMax {
+		t.Fatal(stats)
+	}
+
+	// rules that never matched are listed too
+	if taipei == nil || taipei.Hits != 0 {
+		t.Fatal(taipei)
+	}
+}
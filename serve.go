@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blocklistFiles serves the blocklist, its exports under /export/, and
+// their gzip. The plain names are sent gzip encoded to the clients accepting
+// it, conditional and range requests are handled by http.ServeContent with
+// an ETag of the file served. HEAD reports the entries and the generation
+// time of the list.
+type blocklistFiles struct {
+	file string
+}
+
+func (b *blocklistFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, gz := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".gz")
+
+	// the blocklist is served by its base name, its dir stays private
+	var (
+		path, ctype, encoding string
+		entry                 func(line []byte) bool
+	)
+	if name == filepath.Base(b.file) {
+		path, ctype, entry = b.file, "text/plain; charset=utf-8", everyLine
+	} else if v, ok := strings.CutPrefix(name, "export/"); ok {
+		f, ok := lookupExport(v)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		path, ctype, entry = exportPath(b.file, f.name), f.ctype, f.entry
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the entries are counted in the plain file of the one served
+	plain := path
+
+	if gz {
+		path, ctype = path+".gz", "application/gzip"
+	} else {
+		if acceptsGzip(r) {
+			path, encoding = path+".gz", "gzip"
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("serve blocklist", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		slog.Error("serve blocklist", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the files are replaced as a whole, so their time and size change
+	// with the content
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, st.ModTime().UnixNano(), st.Size()))
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	if r.Method == http.MethodHead {
+		if entry != nil {
+			entries, err := countEntries(plain, entry)
+			if err != nil {
+				slog.Error("serve blocklist", "err", err)
+			} else {
+				w.Header().Set("X-Blocklist-Entries", strconv.Itoa(entries))
+			}
+		}
+		w.Header().Set("X-Blocklist-Generated", st.ModTime().UTC().Format(time.RFC3339))
+	}
+
+	http.ServeContent(w, r, path, st.ModTime(), f)
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r allows gzip, an
+// explicit gzip weight takes precedence over the one of *.
+func acceptsGzip(r *http.Request) bool {
+	gzip, any := -1.0, -1.0
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, v := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(v, ";")
+
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip":
+				gzip = q
+			case "*":
+				any = q
+			}
+		}
+	}
+
+	if gzip >= 0 {
+		return gzip > 0
+	}
+	return any > 0
+}
+
+// countEntries returns the number of lines of path that are entries.
+func countEntries(path string, entry func(line []byte) bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if entry(s.Bytes()) {
+			n++
+		}
+	}
+	return n, s.Err()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlocklistFiles(t *testing.T) {
+	// the file is served by its relative name
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	content := "Autogen[Xunlei]:192.0.2.1-192.0.2.1\nAutogen[pbh]:198.51.100.0-198.51.100.255\n"
+	if err := writeBlocklist("blocklist.txt", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHandler("blocklist.txt", nil, nil)
+	get := func(method, path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	gunzip := func(b []byte) string {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err = io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// the gzip file is gzip
+	rec := get("GET", "/blocklist.txt.gz")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "" || gunzip(rec.Body.Bytes()) != content {
+		t.Fatal(rec.Code, rec.Header())
+	}
+
+	// the plain file is encoded when accepted only
+	rec = get("GET", "/blocklist.txt")
+	if rec.Body.String() != content || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal(rec.Body.String())
+	}
+	plainTag, modified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+
+	rec = get("GET", "/blocklist.txt", "Accept-Encoding", "deflate, gzip;q=0.5")
+	if rec.Header().Get("Content-Encoding") != "gzip" || gunzip(rec.Body.Bytes()) != content || rec.Header().Get("ETag") == plainTag {
+		t.Fatal(rec.Header())
+	}
+
+	rec = get("GET", "/blocklist.txt", "Accept-Encoding", "gzip;q=0, *")
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Fatal(rec.Header())
+	}
+
+	// conditional requests
+	rec = get("GET", "/blocklist.txt", "If-None-Match", plainTag)
+	if rec.Code != http.StatusNotModified {
+		t.Fatal(rec.Code)
+	}
+
+	rec = get("GET", "/blocklist.txt", "If-Modified-Since", modified)
+	if rec.Code != http.StatusNotModified {
+		t.Fatal(rec.Code)
+	}
+
+	// HEAD reports the list
+	rec = get("HEAD", "/blocklist.txt")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("X-Blocklist-Entries") != "2" || rec.Header().Get("X-Blocklist-Generated") == "" {
+		t.Fatal(rec.Code, rec.Header())
+	}
+
+	if rec := get("GET", "/blocklist.db"); rec.Code != http.StatusNotFound {
+		t.Fatal(rec.Code)
+	}
+
+	// an absolute file is served by its base name, not by its path
+	abs, err := filepath.Abs("blocklist.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newHandler(abs, nil, nil)
+	if rec := get("GET", "/blocklist.txt"); rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatal(rec.Code)
+	}
+	if rec := get("GET", abs); rec.Code != http.StatusNotFound {
+		t.Fatal(rec.Code)
+	}
+}
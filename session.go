@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"path/filepath"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// BlocklistSession is implemented by the clients whose blocklist url and
+// switch are read and set over rpc.
+type BlocklistSession interface {
+	BlocklistSettings(ctx context.Context) (url string, enabled bool, err error)
+	SetBlocklistSettings(ctx context.Context, url string, enabled bool) error
+}
+
+func (t *transmission) BlocklistSettings(ctx context.Context) (string, bool, error) {
+	s, err := t.cli.SessionArgumentsGet(ctx, []string{"blocklist-url", "blocklist-enabled"})
+	if err != nil {
+		return "", false, err
+	}
+	return deref(s.BlocklistURL), deref(s.BlocklistEnabled), nil
+}
+
+func (t *transmission) SetBlocklistSettings(ctx context.Context, url string, enabled bool) error {
+	return t.cli.SessionArgumentsSet(ctx, transmissionrpc.SessionArguments{BlocklistURL: &url, BlocklistEnabled: &enabled})
+}
+
+func (r *resilientClient) BlocklistSettings(ctx context.Context) (u string, enabled bool, err error) {
+	bs, ok := r.cli.(BlocklistSession)
+	if !ok {
+		return "", false, errors.ErrUnsupported
+	}
+
+	err = r.call(ctx, "BlocklistSettings", func(ctx context.Context) error {
+		u, enabled, err = bs.BlocklistSettings(ctx)
+		return err
+	})
+	return u, enabled, err
+}
+
+func (r *resilientClient) SetBlocklistSettings(ctx context.Context, u string, enabled bool) error {
+	bs, ok := r.cli.(BlocklistSession)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	return r.call(ctx, "SetBlocklistSettings", func(ctx context.Context) error { return bs.SetBlocklistSettings(ctx, u, enabled) })
+}
+
+// blocklistURL is the url the named instance downloads the blocklist from:
+// its own, the file in its blocklist_dir, the top level one, or the gzip
+// file served on host, reached on the loopback when host listens on every
+// address.
+func (c *Config) blocklistURL(name string) string {
+	for _, v := range c.instances() {
+		if v.Name != name {
+			continue
+		}
+		if v.BlocklistURL != "" {
+			return v.BlocklistURL
+		}
+		if v.BlocklistDir != "" {
+			return localBlocklistURL(v.BlocklistDir)
+		}
+	}
+	if c.BlocklistURL != "" {
+		return c.BlocklistURL
+	}
+
+	host, port, err := net.SplitHostPort(c.Host)
+	if err != nil {
+		host, port = c.Host, "80"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	// the file is served by its base name only
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: "/" + filepath.Base(c.File) + ".gz"}
+	return u.String()
+}
+
+// transmissionDefaultBlocklistURL is the blocklist-url of a transmission
+// whose blocklist was never set up.
+const transmissionDefaultBlocklistURL = "http://www.example.com/blocklist"
+
+// syncBlocklistSettings points the client at the blocklist on the first
+// run that reaches it, when configure_blocklist is on and the url is unset
+// or transmission's default, so the list of an operator is kept. The file
+// of blocklist_dir is only read through its url, it is set anyway. Every run
+// warns when the settings differ.
+func (t *TBan) syncBlocklistSettings(ctx context.Context, c *Config, inst *instance) {
+	bs, ok := inst.cli.(BlocklistSession)
+	if !ok {
+		return
+	}
+
+	want := c.blocklistURL(inst.name)
+
+	u, enabled, err := bs.BlocklistSettings(ctx)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		slog.Error("blocklist settings", "instance", inst.name, "err", err)
+		return
+	}
+
+	drift := u != want || !enabled
+
+	unset := u == "" || u == transmissionDefaultBlocklistURL || u == want
+	if !inst.blocklistSet && ((c.ConfigureBlocklist && unset) || c.blocklistDir(inst.name) != "") {
+		if drift {
+			if err := bs.SetBlocklistSettings(ctx, want, true); err != nil {
+				slog.Error("set blocklist settings", "instance", inst.name, "err", err)
+				return
+			}
+			slog.Info("blocklist settings", "instance", inst.name, "url", want, "was", u, "enabled", enabled)
+		}
+
+		inst.blocklistSet = true
+		drift = false
+	}
+
+	if drift && !inst.Status().BlocklistDrift {
+		slog.Warn("blocklist settings changed, the blocklist is not used", "instance", inst.name,
+			"url", u, "enabled", enabled, "want", want)
+	}
+
+	inst.setStatus(func(s *InstanceStatus) { s.BlocklistDrift = drift })
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlocklistURL(t *testing.T) {
+	c := defaultConfig()
+
+	for host, want := range map[string]string{
+		":9092":          "http://127.0.0.1:9092/blocklist.txt.gz",
+		"0.0.0.0:9092":   "http://127.0.0.1:9092/blocklist.txt.gz",
+		"[::]:9092":      "http://127.0.0.1:9092/blocklist.txt.gz",
+		"10.0.0.2:8080":  "http://10.0.0.2:8080/blocklist.txt.gz",
+		"[fd00::2]:8080": "http://[fd00::2]:8080/blocklist.txt.gz",
+	} {
+		c.Host = host
+		if u := c.blocklistURL("default"); u != want {
+			t.Fatal(host, u)
+		}
+	}
+
+	// an absolute file is advertised by its base name
+	c.Host, c.File = ":9092", "/var/lib/tban/blocklist.txt"
+	if u := c.blocklistURL("default"); u != "http://127.0.0.1:9092/blocklist.txt.gz" {
+		t.Fatal(u)
+	}
+
+	c.BlocklistURL = "http://nas:9092/blocklist.txt.gz"
+	c.Instances = []Instance{{Name: "remote", BlocklistURL: "http://10.0.0.2:9092/blocklist.txt.gz"}}
+	if c.blocklistURL("remote") != "http://10.0.0.2:9092/blocklist.txt.gz" || c.blocklistURL("other") != c.BlocklistURL {
+		t.Fatal(c.blocklistURL("remote"))
+	}
+
+	c.Instances = append(c.Instances, Instance{Name: "local", BlocklistDir: "/var/lib/transmission"})
+	if u := c.blocklistURL("local"); u != "file:///var/lib/transmission/blocklists/blocklist" {
+		t.Fatal(u)
+	}
+}
+
+func TestWriteLocalBlocklist(t *testing.T) {
+	dir := t.TempDir()
+
+	// the list of earlier versions would be loaded besides blocklist.bin
+	legacy := filepath.Join(dir, "blocklists", "transmission-auto-ban.p2p")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range []struct {
+		content string
+		changed bool
+	}{
+		{"Autogen[Xunlei]:192.0.2.1-192.0.2.1\n", true},
+		{"Autogen[Xunlei]:192.0.2.1-192.0.2.1\n", false},
+		{"", true},
+	} {
+		changed, err := writeLocalBlocklist(dir, []byte(v.content))
+		if err != nil || changed != v.changed {
+			t.Fatal(i, changed, err)
+		}
+		if b, _ := os.ReadFile(filepath.Join(dir, "blocklists", localBlocklist)); string(b) != v.content {
+			t.Fatal(i, string(b))
+		}
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBlocklistSettings(t *testing.T) {
+	settings := map[string]any{"blocklist-url": "http://example.org/level1.gz", "blocklist-enabled": false}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method    string         `json:"method"`
+			Arguments map[string]any `json:"arguments"`
+			Tag       int            `json:"tag"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		if req.Method == "session-set" {
+			for k, v := range req.Arguments {
+				settings[k] = v
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"result": "success", "tag": req.Tag, "arguments": settings})
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL + "/transmission/rpc")
+	tr, err := newTransmission(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfig()
+	inst := &instance{name: "default", cli: tr}
+	tban := &TBan{}
+	ctx := context.Background()
+
+	// the list of the operator is kept and reported
+	tban.syncBlocklistSettings(ctx, c, inst)
+	if settings["blocklist-url"] != "http://example.org/level1.gz" || !inst.Status().BlocklistDrift {
+		t.Fatal(settings)
+	}
+
+	// transmission's default is replaced
+	settings["blocklist-url"] = transmissionDefaultBlocklistURL
+	inst = &instance{name: "default", cli: tr}
+	tban.syncBlocklistSettings(ctx, c, inst)
+	if settings["blocklist-url"] != "http://127.0.0.1:9092/blocklist.txt.gz" || settings["blocklist-enabled"] != true || inst.Status().BlocklistDrift {
+		t.Fatal(settings)
+	}
+
+	// changed by hand, reported and left alone
+	settings["blocklist-enabled"] = false
+	tban.syncBlocklistSettings(ctx, c, inst)
+	if !inst.Status().BlocklistDrift || settings["blocklist-enabled"] != false {
+		t.Fatal(settings)
+	}
+	// the local file is wired up whatever configure_blocklist is
+	c = defaultConfig()
+	c.ConfigureBlocklist = false
+	c.BlocklistDir = "/var/lib/transmission"
+	inst = &instance{name: "default", cli: tr}
+	tban.syncBlocklistSettings(ctx, c, inst)
+	if settings["blocklist-url"] != "file:///var/lib/transmission/blocklists/blocklist" || settings["blocklist-enabled"] != true {
+		t.Fatal(settings)
+	}
+}
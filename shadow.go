@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ShadowMatch is what a shadow detector or rule would have banned. Repeated
+// matches of the same peer and torrent are folded into one record.
+type ShadowMatch struct {
+	Detector string    `json:"detector"`
+	Rule     string    `json:"rule"`
+	Addr     string    `json:"addr"`
+	Client   string    `json:"client"`
+	Torrent  string    `json:"torrent"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Count    int       `json:"count"`
+}
+
+var shadowBucket = []byte("shadow")
+
+// shadowRetention is how long shadow matches are kept.
+const shadowRetention = time.Hour * 24 * 90
+
+var shadowMatchesTotal = newCounter("tban_shadow_matches_total",
+	"Matches of shadow detectors and rules, they are never banned.", "detector", "rule")
+
+func (s ShadowMatch) key() []byte {
+	return []byte(s.Detector + "\x00" + s.Rule + "\x00" + s.Addr + "\x00" + s.Torrent)
+}
+
+// recordShadow adds the matches to the shadow bucket and the metrics.
+func (d *DB) recordShadow(matches []ShadowMatch) {
+	for _, v := range matches {
+		shadowMatchesTotal.Add(1, v.Detector, v.Rule)
+	}
+
+	err := d.db.Batch(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(shadowBucket)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		for _, v := range matches {
+			var s ShadowMatch
+			if old := b.Get(v.key()); old != nil && json.Unmarshal(old, &s) == nil {
+				s.Client = v.Client
+				s.Last = v.Last
+				s.Count++
+			} else {
+				s = v
+				s.Count = 1
+			}
+
+			buf, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(s.key(), buf); err != nil {
+				return err
+			}
+		}
+
+		// drop the matches older than the retention
+		var keys [][]byte
+		_ = b.ForEach(func(k, v []byte) error {
+			var s ShadowMatch
+			if json.Unmarshal(v, &s) != nil || now.Sub(s.Last) > shadowRetention {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.Error("recordShadow", "err", err)
+	}
+}
+
+// shadowMatches returns the matches seen since since, newest first.
+func (d *DB) shadowMatches(since time.Time) ([]ShadowMatch, error) {
+	resp := []ShadowMatch{}
+
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(shadowBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var s ShadowMatch
+			if json.Unmarshal(v, &s) == nil && !s.Last.Before(since) {
+				resp = append(resp, s)
+			}
+			return nil
+		})
+	})
+
+	slices.SortFunc(resp, func(a, b ShadowMatch) int { return b.Last.Compare(a.Last) })
+
+	return resp, err
+}
+
+// shadowReport prints what the shadow detectors and rules would have banned
+// over the past days, it asks the running daemon as the db is locked.
+func shadowReport(args []string) error {
+	var days int
+	c, err := loadConfig("shadow-report", args, func(fs *flag.FlagSet) {
+		fs.IntVar(&days, "days", 7, "report the matches of the past days")
+	})
+	if err != nil {
+		return err
+	}
+
+	var matches []ShadowMatch
+	if err := apiGet(c, fmt.Sprintf("/api/shadow?days=%d", days), &matches); err != nil {
+		return err
+	}
+
+	writeShadowReport(os.Stdout, matches)
+	return nil
+}
+
+func writeShadowReport(w io.Writer, matches []ShadowMatch) {
+	type group struct {
+		detector, rule string
+		addrs          map[string]bool
+		matches        []ShadowMatch
+	}
+
+	var groups []*group
+	for _, v := range matches {
+		i := slices.IndexFunc(groups, func(g *group) bool { return g.detector == v.Detector && g.rule == v.Rule })
+		if i == -1 {
+			groups = append(groups, &group{detector: v.Detector, rule: v.Rule, addrs: map[string]bool{}})
+			i = len(groups) - 1
+		}
+		groups[i].addrs[v.Addr] = true
+		groups[i].matches = append(groups[i].matches, v)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	for _, g := range groups {
+		fmt.Fprintf(tw, "# %s: %s, %d addresses\n", g.detector, g.rule, len(g.addrs))
+
+		for _, v := range g.matches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n",
+				v.Addr, v.Client, v.Torrent, v.Count,
+				v.First.Local().Format(time.DateTime), v.Last.Local().Format(time.DateTime))
+		}
+	}
+}
+
+// apiGet decodes the json response of the running daemon.
+func apiGet(c *Config, path string, v any) error {
+	host := c.Host
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+
+	resp, err := http.Get("http://" + host + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestShadowRules(t *testing.T) {
+	ds, err := newDetectors([]DetectorConfig{
+		{Name: "client", Type: DetectorTypeClient, ShadowRules: []string{"^Deluge", "^Xunlei"}},
+		{Name: "peerid", Type: DetectorTypePeerID, Rules: []string{"Transmission < 3"}, Shadow: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent := &transmissionrpc.Torrent{}
+
+	hits := detectAll(ds, torrent, &transmissionrpc.Peer{ClientName: "Deluge 2.1.1"})
+	if len(hits) != 1 || !hits[0].Shadow || hits[0].Rule != "^Deluge" {
+		t.Fatal(hits)
+	}
+
+	// built-in patterns still ban, the shadow rule matching the same peer
+	// is recorded too
+	hits = detectAll(ds, torrent, &transmissionrpc.Peer{ClientName: "Xunlei 0.0.1.2"})
+	if len(hits) != 2 || hits[0].Shadow || !hits[1].Shadow || hits[1].Rule != "^Xunlei" {
+		t.Fatal(hits)
+	}
+
+	hits = detectAll(ds, torrent, &transmissionrpc.Peer{ClientName: "Transmission 2.94"})
+	if len(hits) != 1 || !hits[0].Shadow || hits[0].Detector != "peerid" {
+		t.Fatal(hits)
+	}
+
+	// a shadow rule must not turn a live rule into shadow only
+	for _, d := range []DetectorConfig{
+		{Name: "client", Type: DetectorTypeClient, ShadowRules: []string{blocklist[0]}},
+		{Name: "client", Type: DetectorTypeClient, Patterns: []string{"^Deluge"}, ShadowRules: []string{"^Deluge"}},
+		{Name: "peerid", Type: DetectorTypePeerID, Rules: []string{"Transmission < 3"}, ShadowRules: []string{"Transmission < 3"}},
+	} {
+		if err := d.Validate(); err == nil {
+			t.Fatal(d)
+		}
+	}
+}
+
+func TestRecordShadow(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	m := ShadowMatch{Detector: "client", Rule: "^Deluge", Addr: "1.2.3.4", Client: "Deluge 2.1.1", Torrent: "debian.iso", First: now, Last: now}
+
+	db.recordShadow([]ShadowMatch{m})
+	m.Last = now.Add(time.Minute)
+	db.recordShadow([]ShadowMatch{m})
+
+	rec := httptest.NewRecorder()
+	newHandler("blocklist.txt", db, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/api/shadow?days=1", nil))
+
+	var matches []ShadowMatch
+	if err := json.NewDecoder(rec.Body).Decode(&matches); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != 1 || matches[0].Count != 2 || !matches[0].First.Equal(now) {
+		t.Fatal(matches)
+	}
+	t.Log(matches)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// spoofClient is what a genuine build of a mainstream client reports.
+type spoofClient struct {
+	minParts, maxParts int
+	minMajor, maxMajor int
+}
+
+var spoofClients = map[string]spoofClient{
+	"qbittorrent":  {3, 4, 2, 5},
+	"transmission": {2, 3, 1, 4},
+	"µtorrent":     {3, 4, 1, 3},
+	"deluge":       {2, 4, 1, 2},
+	"bitcomet":     {2, 3, 0, 2},
+	"biglybt":      {3, 4, 1, 4},
+	"ktorrent":     {2, 3, 2, 24},
+	"libtorrent":   {3, 4, 0, 2},
+}
+
+// spoofDetector flags peers whose reported client name disagrees with the
+// decoded peer id when the backend exposes it, carries a malformed or
+// impossible version of a mainstream client, or claims a mainstream client
+// but never reports progress while we keep uploading to it.
+type spoofDetector struct {
+	name string
+	// ratio of the torrent size uploaded without any progress
+	ratio float64
+
+	mu    sync.Mutex
+	peers map[string]*spoofState
+}
+
+type spoofState struct {
+	progress float64
+	uploaded float64
+	last     time.Time
+	seen     bool
+}
+
+func newSpoofDetector(name string, ratio float64) *spoofDetector {
+	return &spoofDetector{name: name, ratio: ratio, peers: map[string]*spoofState{}}
+}
+
+func (s *spoofDetector) Name() string { return s.name }
+
+func (s *spoofDetector) Detect(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	// transmission only reports the client name, the raw peer id is not
+	// exposed by its rpc and the name is not compared
+	if rule, ok := checkSpoof(p.ClientName, peerIDs.get(p.Address, p.Port)); ok {
+		return rule, true
+	}
+
+	if _, ok := spoofClients[spoofKey(DecodeClient(p.ClientName))]; !ok {
+		return "", false
+	}
+
+	return s.checkProgress(t, p)
+}
+
+// checkSpoof compares the client name with the peer id when there is one,
+// and the reported version with what the claimed client really uses. A
+// version that does not parse, such as a beta suffix, is unknown.
+func checkSpoof(name, peerID string) (string, bool) {
+	n := DecodeClient(name)
+
+	if peerID != "" {
+		id := DecodePeerID(peerID)
+		if id.Style != PeerIDStyleName && n.Style == PeerIDStyleName &&
+			!matchClientName(id.Client, n) && !matchClientName(id.Code, n) {
+			return "name-peerid-mismatch", true
+		}
+	}
+
+	c, ok := spoofClients[spoofKey(n)]
+	if !ok || n.Style != PeerIDStyleName {
+		return "", false
+	}
+
+	if len(n.Version) == 0 {
+		return "", false
+	}
+
+	if len(n.Version) < c.minParts || len(n.Version) > c.maxParts {
+		return "malformed-version", true
+	}
+
+	if n.Version[0] < c.minMajor || n.Version[0] > c.maxMajor {
+		return "impossible-version", true
+	}
+
+	return "", false
+}
+
+// peerIDs are the raw peer ids of the backends that expose them, by
+// address and port, the spoof detector compares them with the names.
+var peerIDs = &peerIDStore{ids: map[string]peerIDEntry{}}
+
+type peerIDStore struct {
+	mu    sync.Mutex
+	ids   map[string]peerIDEntry
+	swept time.Time
+}
+
+type peerIDEntry struct {
+	id   string
+	seen time.Time
+}
+
+// peerIDTTL is how long a peer id is kept after its peer was last listed.
+const peerIDTTL = time.Hour
+
+func (s *peerIDStore) set(addr string, port int64, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.ids[net.JoinHostPort(addr, strconv.FormatInt(port, 10))] = peerIDEntry{id, now}
+
+	if now.Sub(s.swept) < peerIDTTL {
+		return
+	}
+	for k, v := range s.ids {
+		if now.Sub(v.seen) > peerIDTTL {
+			delete(s.ids, k)
+		}
+	}
+	s.swept = now
+}
+
+func (s *peerIDStore) get(addr string, port int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[net.JoinHostPort(addr, strconv.FormatInt(port, 10))].id
+}
+
+// spoofKey is the lower case client name without the "/version" suffix some
+// clients put into their extension handshake.
+func spoofKey(p PeerID) string {
+	name, _, _ := strings.Cut(strings.ToLower(p.Client), "/")
+	return name
+}
+
+func (s *spoofDetector) checkProgress(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	if t.TotalSize == nil || t.TotalSize.Byte() <= 0 {
+		return "", false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := deref(t.HashString) + "/" + p.Address
+	now := time.Now()
+
+	st, ok := s.peers[key]
+	if !ok || p.Progress > st.progress {
+		s.peers[key] = &spoofState{progress: p.Progress, last: now, seen: true}
+		return "", false
+	}
+
+	// the rate is a sample, assume it held since the last run but no
+	// longer than a scan interval
+	elapsed := min(now.Sub(st.last), conf().ScanInterval)
+	st.uploaded += float64(p.RateToPeer) * elapsed.Seconds()
+	st.last = now
+	st.seen = true
+
+	if p.Progress < 1 && st.uploaded >= t.TotalSize.Byte()*s.ratio {
+		return "no-progress", true
+	}
+
+	return "", false
+}
+
+func (s *spoofDetector) Cycle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range s.peers {
+		if !v.seen {
+			delete(s.peers, k)
+			continue
+		}
+		v.seen = false
+	}
+}
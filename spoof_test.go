@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestCheckSpoof(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		peerID string
+		rule   string
+	}{
+		{"qBittorrent 4.6.2", "", ""},
+		{"qBittorrent/4.6.2", "", ""},
+		{"Transmission 4.0.5", "", ""},
+		{"-XL0012-", "", ""},
+		{"qBittorrent 4.6", "", "malformed-version"},
+		{"qBittorrent", "", ""},
+		{"qBittorrent/4.6.2beta", "", ""},
+		{"qBittorrent 4.6.2.1.0", "", "malformed-version"},
+		{"qBittorrent 14.6.2", "", "impossible-version"},
+		{"qBittorrent 4.6.2", "-XL0012-abcdefghijkl", "name-peerid-mismatch"},
+		{"qBittorrent 4.6.2", "-qB4620-abcdefghijkl", ""},
+	} {
+		rule, _ := checkSpoof(v.name, v.peerID)
+		if rule != v.rule {
+			t.Error(v.name, v.peerID, rule)
+		}
+	}
+}
+
+func TestSpoofProgress(t *testing.T) {
+	hash := "abc"
+	size := cunits.Bits(100 * MiB * 8)
+	torrent := &transmissionrpc.Torrent{HashString: &hash, TotalSize: &size}
+	peer := &transmissionrpc.Peer{Address: "203.0.113.1", ClientName: "qBittorrent 4.6.2", RateToPeer: int64(MiB)}
+
+	d := newSpoofDetector("spoof", 0.5)
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected at first sight")
+	}
+
+	// 50MiB at 1MiB/s
+	d.peers[hash+"/"+peer.Address].last = time.Now().Add(-time.Second * 60)
+	if rule, ok := d.Detect(torrent, peer); !ok || rule != "no-progress" {
+		t.Fatal("not detected")
+	}
+
+	peer.Progress = 0.1
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected with progress")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// sdNotify sends state to systemd, it is a no-op when not started by
+// systemd with Type=notify.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("sd_notify", "state", state, "err", err)
+	}
+}
+
+func sdStatus(at time.Time, err error, clients, rules int) {
+	if err != nil {
+		sdNotify(fmt.Sprintf("STATUS=last run failed at %s: %v, %d clients banned, %d rules",
+			at.Format(time.DateTime), err, clients, rules))
+		return
+	}
+
+	sdNotify(fmt.Sprintf("STATUS=last run ok at %s, %d clients banned, %d rules",
+		at.Format(time.DateTime), clients, rules))
+}
+
+// sdWatchdog pings the systemd watchdog until ctx is done. A ping is skipped
+// when alive reports false, so a stuck run gets the service restarted.
+func sdWatchdog(ctx context.Context, alive func() bool) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("sd watchdog", "err", err)
+		return
+	}
+
+	if interval <= 0 {
+		return
+	}
+
+	timer := time.NewTicker(interval / 2)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if alive() {
+			sdNotify(daemon.SdNotifyWatchdog)
+		} else {
+			slog.Warn("sd watchdog: run stuck, skip ping")
+		}
+	}
+}
+
+// listeners returns the sockets passed by systemd socket activation, or
+// listens on host when there are none.
+func listeners(host string) ([]net.Listener, error) {
+	ls, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp []net.Listener
+	for _, v := range ls {
+		// fds that are not stream sockets are nil
+		if v != nil {
+			slog.Info("socket activation", "addr", v.Addr())
+			resp = append(resp, v)
+		}
+	}
+
+	if len(resp) > 0 {
+		return resp, nil
+	}
+
+	l, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	return []net.Listener{l}, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// transmission is the Transmission RPC backend. Transmission has no peer
+// ban, banned peers are kept out by the blocklist.
+type transmission struct {
+	cli *transmissionrpc.Client
+	// url, http and session are for the torrent-get calls the rpc library
+	// cannot make
+	url     *url.URL
+	http    *http.Client
+	session atomic.Value
+
+	// ids maps the hashes of the last listing to the torrent ids some
+	// calls of the rpc library take
+	mu    sync.Mutex
+	ids   map[string]int64
+	scans int
+	// instance is the name whose policies tell whether every peer list
+	// is fetched
+	instance string
+	// since is the start of the last listing whose peers were fetched
+	since time.Time
+}
+
+func newTransmission(u *url.URL) (*transmission, error) {
+	cli, err := transmissionrpc.New(u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &transmission{cli: cli, url: u, http: &http.Client{Timeout: time.Minute}, ids: map[string]int64{}}, nil
+}
+
+// transmissionFields are the fields the scan and the policies read, the
+// peers are fetched separately.
+var transmissionFields = []string{
+	"id", "hashString", "name", "status", "totalSize", "uploadRatio", "addedDate", "activityDate",
+	"secondsSeeding", "downloadDir", "uploadLimited", "uploadLimit", "isPrivate", "labels", "trackers",
+	"corruptEver", "peersConnected",
+}
+
+// transmissionFullScan is how often the peers of torrents that were not
+// active since the last scan are fetched, such peers are connected but idle.
+const transmissionFullScan = 10
+
+// transmissionActivitySlack widens the activity window for the clock skew
+// between the hosts and the second resolution of activityDate.
+const transmissionActivitySlack = time.Minute
+
+// Torrents lists every torrent with the fields in transmissionFields, then
+// the peers of the torrents with connected peers that were active since the
+// last scan, whatever the scan interval. Transmission's "recently-active"
+// covers the last minute only. Every transmissionFullScan scans, and every
+// scan while a policy of the instance matches peer_asn or peer_country, the
+// peers of all torrents with connected peers are fetched.
+func (t *transmission) Torrents(ctx context.Context) ([]transmissionrpc.Torrent, error) {
+	started := time.Now()
+
+	var at []transmissionrpc.Torrent
+	if err := t.torrentGet(ctx, transmissionFields, nil, &at); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	full := t.scans%transmissionFullScan == 0 || t.since.IsZero() || conf().peerGeoPolicies(t.instance)
+	t.scans++
+	since := t.since.Add(-transmissionActivitySlack)
+	t.mu.Unlock()
+
+	ids := make(map[string]int64, len(at))
+	index := make(map[int64]int, len(at))
+	var fetch []int64
+	for i, v := range at {
+		if v.HashString != nil && v.ID != nil {
+			ids[*v.HashString] = *v.ID
+			index[*v.ID] = i
+		}
+		if v.ID == nil || deref(v.PeersConnected) == 0 {
+			continue
+		}
+		if full || (v.ActivityDate != nil && v.ActivityDate.After(since)) {
+			fetch = append(fetch, *v.ID)
+		}
+	}
+
+	t.mu.Lock()
+	t.ids = ids
+	t.mu.Unlock()
+
+	if len(fetch) > 0 {
+		var peers []transmissionrpc.Torrent
+		if err := t.torrentGet(ctx, []string{"id", "peers"}, fetch, &peers); err != nil {
+			return nil, err
+		}
+
+		for _, v := range peers {
+			if v.ID == nil {
+				continue
+			}
+			// added after the listing
+			if i, ok := index[*v.ID]; ok {
+				at[i].Peers = v.Peers
+				if at[i].Peers == nil {
+					at[i].Peers = []transmissionrpc.Peer{}
+				}
+			}
+		}
+	}
+
+	// the torrents without connections have no peers to fetch
+	for i, v := range at {
+		if v.Peers == nil && deref(v.PeersConnected) == 0 {
+			at[i].Peers = []transmissionrpc.Peer{}
+		}
+	}
+
+	// a failed scan leaves the window open, the next one covers it
+	t.mu.Lock()
+	t.since = started
+	t.mu.Unlock()
+
+	return at, nil
+}
+
+func (t *transmission) torrentGet(ctx context.Context, fields []string, ids any, torrents *[]transmissionrpc.Torrent) error {
+	args := map[string]any{"fields": fields}
+	if ids != nil {
+		args["ids"] = ids
+	}
+
+	var result struct {
+		Torrents []transmissionrpc.Torrent `json:"torrents"`
+	}
+	if err := t.rpc(ctx, "torrent-get", args, &result); err != nil {
+		return err
+	}
+
+	*torrents = result.Torrents
+	return nil
+}
+
+// rpc calls method, it gets a new session id and retries once when the
+// session id is missing or expired.
+func (t *transmission) rpc(ctx context.Context, method string, args, result any) error {
+	body, err := json.Marshal(map[string]any{"method": method, "arguments": args})
+	if err != nil {
+		return err
+	}
+
+	for range 2 {
+		u := *t.url
+		u.User = nil
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if id, ok := t.session.Load().(string); ok {
+			req.Header.Set(transmissionSessionHeader, id)
+		}
+		if t.url.User != nil {
+			password, _ := t.url.User.Password()
+			req.SetBasicAuth(t.url.User.Username(), password)
+		}
+
+		resp, err := t.http.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusConflict {
+			resp.Body.Close()
+			t.session.Store(resp.Header.Get(transmissionSessionHeader))
+			continue
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("transmission %s: %s", method, resp.Status)
+		}
+
+		r := struct {
+			Result    string `json:"result"`
+			Arguments any    `json:"arguments"`
+		}{Arguments: result}
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return fmt.Errorf("transmission %s: %w", method, err)
+		}
+
+		if r.Result != "success" {
+			return fmt.Errorf("transmission %s: %s", method, r.Result)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("transmission %s: session id rejected twice", method)
+}
+
+const transmissionSessionHeader = "X-Transmission-Session-Id"
+
+func (t *transmission) ReloadBlocklist(ctx context.Context) (int64, error) {
+	return t.cli.BlocklistUpdate(ctx)
+}
+
+func (t *transmission) StopTorrents(ctx context.Context, hashes []string) error {
+	return t.cli.TorrentStopHashes(ctx, hashes)
+}
+
+func (t *transmission) StartTorrents(ctx context.Context, hashes []string) error {
+	return t.cli.TorrentStartHashes(ctx, hashes)
+}
+
+func (t *transmission) BanPeers(context.Context, []netip.AddrPort) error { return nil }
+
+func (t *transmission) RemoveTorrents(ctx context.Context, hashes []string, deleteData bool) error {
+	ids, err := t.lookup(hashes)
+	if err != nil {
+		return err
+	}
+	return t.cli.TorrentRemove(ctx, transmissionrpc.TorrentRemovePayload{IDs: ids, DeleteLocalData: deleteData})
+}
+
+func (t *transmission) MoveTorrents(ctx context.Context, hashes []string, dir string) error {
+	ids, err := t.lookup(hashes)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err = errors.Join(err, t.cli.TorrentSetLocation(ctx, id, dir, true))
+	}
+
+	return err
+}
+
+func (t *transmission) LimitTorrents(ctx context.Context, hashes []string, limit int64) error {
+	ids, err := t.lookup(hashes)
+	if err != nil {
+		return err
+	}
+
+	limited := true
+	return t.cli.TorrentSet(ctx, transmissionrpc.TorrentSetPayload{
+		IDs:           ids,
+		UploadLimit:   &limit,
+		UploadLimited: &limited,
+	})
+}
+
+// AddTorrent adds the torrent and verifies it, so transmission seeds the
+// complete data instead of downloading it again.
+func (t *transmission) AddTorrent(ctx context.Context, metainfo []byte, dir string, labels []string) error {
+	s := base64.StdEncoding.EncodeToString(metainfo)
+
+	v, err := t.cli.TorrentAdd(ctx, transmissionrpc.TorrentAddPayload{MetaInfo: &s, DownloadDir: &dir, Labels: labels})
+	if err != nil {
+		return err
+	}
+
+	if v.ID == nil {
+		return nil
+	}
+	// the torrent is added, a failed verify leaves it to download the data
+	// again but must not make the caller remove the data under it
+	if err := t.cli.TorrentVerifyIDs(ctx, []int64{*v.ID}); err != nil {
+		slog.Error("verify added torrent", "name", deref(v.Name), "err", err)
+	}
+	return nil
+}
+
+func (t *transmission) lookup(hashes []string) ([]int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var (
+		ids []int64
+		err error
+	)
+	for _, h := range hashes {
+		id, ok := t.ids[h]
+		if !ok {
+			err = errors.Join(err, fmt.Errorf("unknown torrent %s", h))
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, err
+}
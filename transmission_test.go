@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+// standInTransmission is a transmission rpc server with n torrents, one in
+// ten of them has peers and an activityDate of now, another one in ten has
+// peers and an activityDate an hour ago. It answers torrent-get with
+// the requested fields only, and counts the bytes it sent.
+type standInTransmission struct {
+	torrents []map[string]json.RawMessage
+	sent     atomic.Int64
+	requests atomic.Int64
+}
+
+func newStandInTransmission(tb testing.TB, n int) (*httptest.Server, *standInTransmission) {
+	s := &standInTransmission{}
+
+	now := time.Now()
+	for i := range n {
+		id, hash, name := int64(i+1), fmt.Sprintf("%040x", i), fmt.Sprintf("torrent %d", i)
+		status, size, ratio, private := transmissionrpc.TorrentStatusSeed, cunits.Bits(8*GiB), 1.5, false
+		seeding, connected, activity := time.Hour*24*30, int64(0), now
+		pieces, magnet, comment := string(make([]byte, 1024)), "magnet:?xt=urn:btih:"+hash, "stand-in torrent"
+
+		v := transmissionrpc.Torrent{
+			ID: &id, HashString: &hash, Name: &name, Status: &status, TotalSize: &size, UploadRatio: &ratio,
+			IsPrivate: &private, AddedDate: &now, ActivityDate: &activity, TimeSeeding: &seeding, DownloadDir: &name,
+			Pieces: &pieces, MagnetLink: &magnet, Comment: &comment, PeersConnected: &connected,
+			Labels:   []string{"tv"},
+			Trackers: []transmissionrpc.Tracker{{Announce: "udp://tracker.example.org:1337/announce"}},
+		}
+		for j := range 20 {
+			v.Files = append(v.Files, transmissionrpc.TorrentFile{Name: fmt.Sprintf("%s/%d.mkv", name, j), Length: 400 * 1024 * 1024})
+			v.FileStats = append(v.FileStats, transmissionrpc.TorrentFileStat{Wanted: true})
+		}
+
+		if i%10 == 0 || i%10 == 5 {
+			for j := range 20 {
+				v.Peers = append(v.Peers, transmissionrpc.Peer{Address: fmt.Sprintf("192.0.2.%d", j), Port: 6881, ClientName: "Transmission 4.0.6"})
+			}
+			connected = int64(len(v.Peers))
+		}
+		if i%10 != 0 {
+			activity = now.Add(-time.Hour)
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			tb.Fatal(err)
+		}
+		s.torrents = append(s.torrents, m)
+	}
+
+	srv := httptest.NewServer(s)
+	tb.Cleanup(srv.Close)
+
+	return srv, s
+}
+
+func (s *standInTransmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(transmissionSessionHeader) != "stand-in" {
+		w.Header().Set(transmissionSessionHeader, "stand-in")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	s.requests.Add(1)
+
+	var req struct {
+		Method    string `json:"method"`
+		Tag       int    `json:"tag"`
+		Arguments struct {
+			Fields []string        `json:"fields"`
+			IDs    json.RawMessage `json:"ids"`
+		} `json:"arguments"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "torrent-get" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var ids []int64
+	switch string(req.Arguments.IDs) {
+	case "":
+	default:
+		if err := json.Unmarshal(req.Arguments.IDs, &ids); err != nil {
+			http.Error(w, "bad ids", http.StatusBadRequest)
+			return
+		}
+	}
+
+	torrents := s.torrents
+	if ids != nil {
+		torrents = nil
+		for _, id := range ids {
+			if id > 0 && int(id) <= len(s.torrents) {
+				torrents = append(torrents, s.torrents[id-1])
+			}
+		}
+	}
+
+	resp := make([]map[string]json.RawMessage, 0, len(torrents))
+	for _, v := range torrents {
+		m := make(map[string]json.RawMessage, len(req.Arguments.Fields))
+		for _, f := range req.Arguments.Fields {
+			if x, ok := v[f]; ok {
+				m[f] = x
+			}
+		}
+		resp = append(resp, m)
+	}
+
+	b, _ := json.Marshal(map[string]any{"result": "success", "tag": req.Tag, "arguments": map[string]any{"torrents": resp}})
+	s.sent.Add(int64(len(b)))
+	_, _ = w.Write(b)
+}
+
+func TestTransmissionTorrents(t *testing.T) {
+	c := *defaultConfig()
+	old := config.Swap(&c)
+	t.Cleanup(func() { config.Store(old) })
+
+	srv, s := newStandInTransmission(t, 100)
+
+	u, _ := url.Parse(srv.URL + "/transmission/rpc")
+	tr, err := newTransmission(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first scan is a full one, the others fetch the peers of the
+	// torrents active since the last scan
+	for i, want := range []int{20 * 20, 10 * 20} {
+		at, err := tr.Torrents(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peers := 0
+		for _, v := range at {
+			if v.Pieces != nil || v.Files != nil {
+				t.Fatal("unrequested fields")
+			}
+			peers += len(v.Peers)
+		}
+
+		if len(at) != 100 || peers != want || (i > 0 && len(at[5].Peers) != 0) || *at[10].HashString != fmt.Sprintf("%040x", 10) || len(at[10].Peers) != 20 {
+			t.Fatal(len(at), peers)
+		}
+	}
+
+	// a full listing, all peers, a full listing and the active peers
+	if n := s.requests.Load(); n != 4 {
+		t.Fatal(n)
+	}
+
+	// a peer_asn policy reads the peers of the idle torrents on every scan
+	c.Policies = append(slices.Clip(c.Policies), Policy{Name: "asn", Action: PolicyActionStop, Match: PolicyMatch{PeerASN: []uint{64496}}})
+	at, err := tr.Torrents(context.Background())
+	if err != nil || len(at[5].Peers) != 20 {
+		t.Fatal(err)
+	}
+
+	if ids, err := tr.lookup([]string{fmt.Sprintf("%040x", 99)}); err != nil || ids[0] != 100 {
+		t.Fatal(ids, err)
+	}
+}
+
+// BenchmarkTransmissionTorrents compares the scan with TorrentGetAll on a
+// library of 10k torrents.
+func BenchmarkTransmissionTorrents(b *testing.B) {
+	old := config.Swap(defaultConfig())
+	b.Cleanup(func() { config.Store(old) })
+
+	srv, s := newStandInTransmission(b, 10000)
+	u, _ := url.Parse(srv.URL + "/transmission/rpc")
+
+	// the json the server sent per scan
+	sent := func(b *testing.B) {
+		b.ReportMetric(float64(s.sent.Swap(0))/float64(b.N), "rpc-bytes/op")
+	}
+
+	b.Run("TorrentGetAll", func(b *testing.B) {
+		cli, err := transmissionrpc.New(u, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sent(b)
+		s.sent.Store(0)
+
+		for range b.N {
+			if _, err := cli.TorrentGetAll(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Torrents", func(b *testing.B) {
+		tr, err := newTransmission(u)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sent(b)
+		s.sent.Store(0)
+
+		for range b.N {
+			if _, err := tr.Torrents(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
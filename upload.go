@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/hekmon/transmissionrpc/v3"
+	"go.etcd.io/bbolt"
+)
+
+// uploadDetector flags peers that took far more than the torrent size from
+// us. A genuine client downloads every piece once, offline download
+// services and traffic vampires download the same torrent again and again,
+// often from several addresses of the same prefix, or spread what they take
+// over many torrents.
+type uploadDetector struct {
+	name string
+	// ratio of the torrent size one address may take
+	ratio float64
+	// prefixRatio of the torrent size one prefix may take
+	prefixRatio float64
+	// maxUpload and maxPrefixUpload are the bytes one address or prefix may
+	// take across all torrents, 0 has no limit
+	maxUpload, maxPrefixUpload Size
+
+	tracker *uploadTracker
+}
+
+func newUploadDetector(name string, ratio, prefixRatio float64, maxUpload, maxPrefixUpload Size, window time.Duration) *uploadDetector {
+	return &uploadDetector{
+		name: name, ratio: ratio, prefixRatio: prefixRatio,
+		maxUpload: maxUpload, maxPrefixUpload: maxPrefixUpload,
+		tracker: getUploadTracker(name, window),
+	}
+}
+
+func (u *uploadDetector) Name() string { return u.name }
+
+func (u *uploadDetector) Detect(t *transmissionrpc.Torrent, p *transmissionrpc.Peer) (string, bool) {
+	if t.TotalSize == nil || t.TotalSize.Byte() <= 0 || t.HashString == nil {
+		return "", false
+	}
+
+	addr, err := netip.ParseAddr(p.Address)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+
+	prefix := uploadPrefix(addr)
+	size := t.TotalSize.Byte()
+
+	c := u.tracker.add(addr.String(), prefix.String(), *t.HashString, p.RateToPeer)
+
+	if c.ip >= size*u.ratio {
+		return "excessive-upload", true
+	}
+
+	if c.prefix >= size*u.prefixRatio {
+		return "excessive-upload-prefix", true
+	}
+
+	if u.maxUpload > 0 && c.ipTotal >= float64(u.maxUpload) {
+		return "excessive-upload-total", true
+	}
+
+	if u.maxPrefixUpload > 0 && c.prefixTotal >= float64(u.maxPrefixUpload) {
+		return "excessive-upload-prefix-total", true
+	}
+
+	return "", false
+}
+
+// uploadPrefix is the prefix size of the merged PBH rules, /24 and /56.
+func uploadPrefix(addr netip.Addr) netip.Prefix {
+	bits := 56
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+const (
+	uploadKindIP     = "ip"
+	uploadKindPrefix = "prefix"
+)
+
+// uploadKey is the counter of an address or prefix on one torrent, or
+// across all torrents when hash is empty.
+type uploadKey struct {
+	kind string
+	addr string
+	hash string
+}
+
+type uploadCounter struct {
+	// uploaded bytes
+	uploaded float64
+	// last is the last time the rate was sampled
+	last  time.Time
+	dirty bool
+}
+
+// uploadTracker accumulates the bytes uploaded to each address and prefix
+// per torrent, it is shared by the detectors of the same name so a torrent
+// moving from downloading to seeding keeps its counters.
+type uploadTracker struct {
+	name   string
+	window time.Duration
+
+	mu       sync.Mutex
+	counters map[uploadKey]*uploadCounter
+	// deleted are the expired counters to remove from the db
+	deleted []uploadKey
+}
+
+var (
+	uploadTrackersMu sync.Mutex
+	uploadTrackers   = map[string]*uploadTracker{}
+)
+
+// getUploadTracker returns the tracker of the detector name, a zero window
+// keeps the current one.
+func getUploadTracker(name string, window time.Duration) *uploadTracker {
+	uploadTrackersMu.Lock()
+	defer uploadTrackersMu.Unlock()
+
+	t, ok := uploadTrackers[name]
+	if !ok {
+		t = &uploadTracker{name: name, window: time.Hour * 24 * 7, counters: map[uploadKey]*uploadCounter{}}
+		uploadTrackers[name] = t
+	}
+
+	if window > 0 {
+		t.mu.Lock()
+		t.window = window
+		t.mu.Unlock()
+	}
+
+	return t
+}
+
+// uploadTotals are the bytes uploaded to an address and its prefix, on the
+// torrent and across all torrents.
+type uploadTotals struct {
+	ip, prefix           float64
+	ipTotal, prefixTotal float64
+}
+
+// add samples rate into the address and prefix counters of the torrent and
+// of all torrents, and returns them.
+func (u *uploadTracker) add(addr, prefix, hash string, rate int64) uploadTotals {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	ip := u.counter(uploadKey{uploadKindIP, addr, hash}, now)
+
+	var bytes float64
+	if !ip.last.IsZero() {
+		// the rate is a sample, assume it held since the last run but no
+		// longer than a scan interval
+		bytes = float64(rate) * min(now.Sub(ip.last), conf().ScanInterval).Seconds()
+	}
+
+	var resp uploadTotals
+	for _, v := range []struct {
+		key uploadKey
+		to  *float64
+	}{
+		{uploadKey{uploadKindIP, addr, hash}, &resp.ip},
+		{uploadKey{uploadKindPrefix, prefix, hash}, &resp.prefix},
+		{uploadKey{uploadKindIP, addr, ""}, &resp.ipTotal},
+		{uploadKey{uploadKindPrefix, prefix, ""}, &resp.prefixTotal},
+	} {
+		c := u.counter(v.key, now)
+		c.uploaded += bytes
+		c.last = now
+		c.dirty = true
+		*v.to = c.uploaded
+	}
+
+	return resp
+}
+
+func (u *uploadTracker) counter(k uploadKey, now time.Time) *uploadCounter {
+	c, ok := u.counters[k]
+	if !ok || now.Sub(c.last) > u.window {
+		c = &uploadCounter{}
+		u.counters[k] = c
+	}
+	return c
+}
+
+// Totals returns the bytes uploaded to each address or prefix across all
+// torrents.
+func (u *uploadTracker) Totals(kind string) map[string]float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	resp := map[string]float64{}
+	for k, v := range u.counters {
+		if k.kind == kind && k.hash == "" {
+			resp[k.addr] = v.uploaded
+		}
+	}
+	return resp
+}
+
+func (u *uploadTracker) expire(now time.Time) {
+	for k, v := range u.counters {
+		if now.Sub(v.last) > u.window {
+			delete(u.counters, k)
+			u.deleted = append(u.deleted, k)
+		}
+	}
+}
+
+var uploadBucket = []byte("upload")
+
+// key is name \0 kind \0 addr \0 hash, value is the uploaded bytes as
+// float64 bits and the unix time of the last sample.
+func (k uploadKey) bytes(name string) []byte {
+	return []byte(name + "\x00" + k.kind + "\x00" + k.addr + "\x00" + k.hash)
+}
+
+func parseUploadKey(b []byte) (string, uploadKey, bool) {
+	s := bytes.Split(b, []byte{0})
+	if len(s) != 4 {
+		return "", uploadKey{}, false
+	}
+	return string(s[0]), uploadKey{string(s[1]), string(s[2]), string(s[3])}, true
+}
+
+// loadUpload restores the upload counters saved by saveUpload.
+func (d *DB) loadUpload() {
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(uploadBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			name, key, ok := parseUploadKey(k)
+			if !ok || len(v) != 16 {
+				return nil
+			}
+
+			t := getUploadTracker(name, 0)
+			t.mu.Lock()
+			t.counters[key] = &uploadCounter{
+				uploaded: math.Float64frombits(binary.BigEndian.Uint64(v[:8])),
+				last:     time.Unix(int64(binary.BigEndian.Uint64(v[8:])), 0),
+			}
+			t.mu.Unlock()
+
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("loadUpload", "err", err)
+	}
+}
+
+// saveUpload writes the changed counters and drops the expired ones.
+func (d *DB) saveUpload() {
+	uploadTrackersMu.Lock()
+	defer uploadTrackersMu.Unlock()
+
+	err := d.db.Batch(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(uploadBucket)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		for name, t := range uploadTrackers {
+			t.mu.Lock()
+
+			t.expire(now)
+			for _, k := range t.deleted {
+				_ = b.Delete(k.bytes(name))
+			}
+			t.deleted = nil
+
+			for k, v := range t.counters {
+				if !v.dirty {
+					continue
+				}
+
+				buf := make([]byte, 16)
+				binary.BigEndian.PutUint64(buf[:8], math.Float64bits(v.uploaded))
+				binary.BigEndian.PutUint64(buf[8:], uint64(v.last.Unix()))
+				_ = b.Put(k.bytes(name), buf)
+				v.dirty = false
+			}
+
+			t.mu.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.Error("saveUpload", "err", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hekmon/cunits/v2"
+	"github.com/hekmon/transmissionrpc/v3"
+)
+
+func TestUploadDetector(t *testing.T) {
+	hash := "abc"
+	size := cunits.Bits(10 * MiB * 8)
+	torrent := &transmissionrpc.Torrent{HashString: &hash, TotalSize: &size}
+
+	d := newUploadDetector("upload-test", 1.5, 2, 0, 0, time.Hour)
+
+	peer := &transmissionrpc.Peer{Address: "203.0.113.1", RateToPeer: int64(MiB)}
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected at first sight")
+	}
+
+	// 10MiB each, the address is below 1.5 but the /24 is at 2
+	d.tracker.counters[uploadKey{uploadKindIP, peer.Address, hash}].last = time.Now().Add(-time.Second * 10)
+	if _, ok := d.Detect(torrent, peer); ok {
+		t.Fatal("detected below the ratio")
+	}
+
+	peer2 := &transmissionrpc.Peer{Address: "203.0.113.2", RateToPeer: int64(MiB)}
+	d.Detect(torrent, peer2)
+	d.tracker.counters[uploadKey{uploadKindIP, peer2.Address, hash}].last = time.Now().Add(-time.Second * 10)
+	if rule, ok := d.Detect(torrent, peer2); !ok || rule != "excessive-upload-prefix" {
+		t.Fatal("prefix not detected", rule)
+	}
+
+	// 10MiB per torrent stays below the ratio, 5 torrents reach the total
+	spread := newUploadDetector("upload-spread", 100, 100, 50*MiB, 0, time.Hour)
+	vampire := &transmissionrpc.Peer{Address: "198.51.100.1", RateToPeer: int64(MiB)}
+	var rule string
+	for i := range 5 {
+		hash := string(rune('a' + i))
+		torrent := &transmissionrpc.Torrent{HashString: &hash, TotalSize: &size}
+
+		spread.Detect(torrent, vampire)
+		spread.tracker.counters[uploadKey{uploadKindIP, vampire.Address, hash}].last = time.Now().Add(-time.Second * 10)
+		rule, _ = spread.Detect(torrent, vampire)
+		if i < 4 && rule != "" {
+			t.Fatal(i, rule)
+		}
+	}
+	if rule != "excessive-upload-total" {
+		t.Fatal("total not detected", rule)
+	}
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.saveUpload()
+	delete(uploadTrackers, "upload-test")
+	db.loadUpload()
+
+	if got := getUploadTracker("upload-test", 0).Totals(uploadKindPrefix)["203.0.113.0/24"]; got < float64(20*MiB) || got > float64(21*MiB) {
+		t.Fatal("prefix total", got)
+	}
+}
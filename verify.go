@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// escalation steps of a ban whose peer is still connected, one per run
+const (
+	EscalateConntrack = "conntrack"
+	EscalateRestart   = "restart"
+	EscalateAlert     = "alert"
+)
+
+var banEscalations = newCounter("tban_ban_escalations_total", "Bans still connected on the next run, by escalation step.", "step")
+
+// banCheck is a ban whose connections are checked on the next runs, Step is
+// the last escalation applied, empty right after the ban.
+type banCheck struct {
+	Addr   string    `json:"addr"`
+	Client string    `json:"client"`
+	Banned time.Time `json:"banned"`
+	Step   string    `json:"step,omitempty"`
+
+	// seen are the torrents of each instance the peer was last connected
+	// to, the ban is only verified where their peer lists were fetched
+	seen map[string][]string
+}
+
+// see records the torrents the peer is connected to in scans.
+func (c *banCheck) see(scans []*scan) {
+	c.seen = map[string][]string{}
+	for _, sc := range scans {
+		for _, v := range sc.connected[c.Addr] {
+			c.seen[sc.inst.name] = append(c.seen[sc.inst.name], v.hash)
+		}
+	}
+}
+
+// verified reports whether scans fetched the peer lists of every torrent the
+// peer was last seen on. An instance whose listing failed, or a torrent whose
+// idle peers were not fetched, tells nothing about the peer.
+func (c *banCheck) verified(scans []*scan) bool {
+	for name, hashes := range c.seen {
+		i := slices.IndexFunc(scans, func(sc *scan) bool { return sc.inst.name == name })
+		if i < 0 {
+			return false
+		}
+		for _, h := range hashes {
+			// a torrent missing from the listing is gone with its peers
+			if fetched, ok := scans[i].fetched[h]; ok && !fetched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// peerTorrent is a torrent a peer is connected to, private torrents and
+// decoys are not restartable.
+type peerTorrent struct {
+	hash        string
+	restartable bool
+}
+
+// killFlows deletes the conntrack entries of addr, so the firewall sees
+// the next packets of established connections as new ones.
+var killFlows = func(addr netip.Addr) (uint, error) {
+	family := netlink.InetFamily(unix.AF_INET)
+	if addr.Unmap().Is6() {
+		family = unix.AF_INET6
+	}
+
+	var n uint
+	for _, tp := range []netlink.ConntrackFilterType{netlink.ConntrackOrigSrcIP, netlink.ConntrackOrigDstIP} {
+		f := &netlink.ConntrackFilter{}
+		if err := f.AddIP(tp, net.IP(addr.Unmap().AsSlice())); err != nil {
+			return n, err
+		}
+
+		x, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, f)
+		n += x
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// verifyBans checks the bans of the previous runs against the peers of this
+// one. A peer that is gone from the fetched peer lists is done with, one
+// still connected is escalated a step each run: its conntrack flows are
+// killed when the firewall is enabled, then its public torrents are
+// restarted, then an alert is sent. A peer whose torrents were not fetched
+// is checked again on the next run.
+func (t *TBan) verifyBans(ctx context.Context, scans []*scan) {
+	restarts := map[*instance][]string{}
+
+	for addr, check := range t.checks {
+		connected := false
+		for _, sc := range scans {
+			if len(sc.connected[addr]) > 0 {
+				connected = true
+			}
+		}
+
+		if !connected {
+			if !check.verified(scans) {
+				continue
+			}
+			slog.Debug("ban effective", "address", addr, "client", check.Client)
+			delete(t.checks, addr)
+			continue
+		}
+		check.see(scans)
+
+		step := nextEscalation(check.Step)
+		if step == EscalateConntrack && !iptEnabled {
+			// without the firewall only the client drops the peer
+			step = nextEscalation(step)
+		}
+
+		if step == EscalateRestart {
+			restartable := false
+			for _, sc := range scans {
+				for _, v := range sc.connected[addr] {
+					if v.restartable {
+						restarts[sc.inst] = append(restarts[sc.inst], v.hash)
+						restartable = true
+					}
+				}
+			}
+
+			if !restartable {
+				step = nextEscalation(step)
+			}
+		}
+
+		banEscalations.Add(1, step)
+		check.Step = step
+
+		switch step {
+		case EscalateConntrack:
+			n, err := killFlows(netip.MustParseAddr(addr))
+			if err != nil {
+				slog.Error("ban not effective, conntrack", "address", addr, "err", err)
+			} else {
+				slog.Warn("ban not effective, conntrack", "address", addr, "client", check.Client, "flows", n)
+			}
+		case EscalateRestart:
+			slog.Warn("ban not effective, restart", "address", addr, "client", check.Client)
+		case EscalateAlert:
+			slog.Error("ban not effective", "address", addr, "client", check.Client, "banned", check.Banned)
+			if err := sendAlert(ctx, conf().AlertURL, *check); err != nil {
+				slog.Error("alert", "err", err)
+			}
+			delete(t.checks, addr)
+		}
+	}
+
+	for _, sc := range scans {
+		torrents := restarts[sc.inst]
+		slices.Sort(torrents)
+		t.restartTorrents(ctx, sc.inst, slices.Compact(torrents))
+	}
+}
+
+func nextEscalation(step string) string {
+	switch step {
+	case "":
+		return EscalateConntrack
+	case EscalateConntrack:
+		return EscalateRestart
+	}
+	return EscalateAlert
+}
+
+// checkBans adds the new bans to the checks of the next run with the
+// torrents scans saw them on, bans already being checked keep their step.
+func (t *TBan) checkBans(bans []entry, scans []*scan) {
+	if t.checks == nil {
+		t.checks = map[string]*banCheck{}
+	}
+
+	now := time.Now()
+	for _, v := range bans {
+		if _, ok := t.checks[v.addr]; ok {
+			continue
+		}
+		if _, err := netip.ParseAddr(v.addr); err != nil {
+			continue
+		}
+		c := &banCheck{Addr: v.addr, Client: v.client, Banned: now}
+		c.see(scans)
+		t.checks[v.addr] = c
+	}
+}
+
+// sendAlert posts the check as json to url, if set.
+func sendAlert(ctx context.Context, url string, check banCheck) error {
+	if url == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alert %s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestVerifyBans(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "blocklist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	alerts := make(chan banCheck, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v banCheck
+		_ = json.NewDecoder(r.Body).Decode(&v)
+		alerts <- v
+	}))
+	defer srv.Close()
+
+	c := *conf()
+	c.AlertURL = srv.URL
+	old := config.Swap(&c)
+	defer config.Store(old)
+
+	var killed []netip.Addr
+	defer func(f func(netip.Addr) (uint, error)) { killFlows = f }(killFlows)
+	killFlows = func(addr netip.Addr) (uint, error) { killed = append(killed, addr); return 1, nil }
+	iptEnabled = true
+	defer func() { iptEnabled = false }()
+
+	f := &fakeClient{}
+	sc := &scan{inst: &instance{name: "a", cli: f}, connected: map[string][]peerTorrent{
+		"192.0.2.1": {{hash: "aa", restartable: true}, {hash: "pp"}},
+		"192.0.2.2": {{hash: "aa", restartable: true}},
+	}, fetched: map[string]bool{"aa": true, "pp": true}}
+
+	tban := &TBan{db: db}
+	tban.checkBans([]entry{{addr: "192.0.2.1", client: "Xunlei"}, {addr: "192.0.2.2"}, {addr: "192.0.2.3"}}, []*scan{sc})
+
+	// the restart does not wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// 192.0.2.3 is gone, the others have their flows killed
+	tban.verifyBans(ctx, []*scan{sc})
+	if len(tban.checks) != 2 || len(killed) != 2 || len(f.stopped) != 0 {
+		t.Fatal(tban.checks, killed, f.stopped)
+	}
+
+	// then their public torrent is restarted once
+	tban.verifyBans(ctx, []*scan{sc})
+	if !slices.Equal(f.stopped, []string{"aa"}) || !slices.Equal(f.started, []string{"aa"}) {
+		t.Fatal(f.stopped, f.started)
+	}
+
+	// then an alert is sent and they are not checked anymore
+	delete(sc.connected, "192.0.2.2")
+	tban.verifyBans(context.Background(), []*scan{sc})
+	if v := <-alerts; v.Addr != "192.0.2.1" || v.Client != "Xunlei" || v.Step != EscalateAlert {
+		t.Fatal(v)
+	}
+	if len(tban.checks) != 0 {
+		t.Fatal(tban.checks)
+	}
+}
+
+func TestVerifyBansUnfetched(t *testing.T) {
+	a := &instance{name: "a", cli: &fakeClient{}}
+	scanOf := func(inst *instance, connected map[string][]peerTorrent, fetched map[string]bool) *scan {
+		return &scan{inst: inst, connected: connected, fetched: fetched}
+	}
+
+	tban := &TBan{}
+	tban.checkBans([]entry{{addr: "192.0.2.5"}}, []*scan{scanOf(a, map[string][]peerTorrent{"192.0.2.5": {{hash: "bb"}}}, map[string]bool{"bb": true})})
+
+	// the idle peers of bb were not fetched, and the listing of a failed
+	tban.verifyBans(context.Background(), []*scan{scanOf(a, nil, map[string]bool{"bb": false})})
+	tban.verifyBans(context.Background(), []*scan{scanOf(&instance{name: "b"}, nil, nil)})
+	if len(tban.checks) != 1 {
+		t.Fatal(tban.checks)
+	}
+
+	tban.verifyBans(context.Background(), []*scan{scanOf(a, nil, map[string]bool{"bb": true})})
+	if len(tban.checks) != 0 {
+		t.Fatal(tban.checks)
+	}
+}
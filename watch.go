@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var watchFiles = map[string]bool{
+	"all.txt":    true,
+	"custom.txt": true,
+}
+
+// watchRule watches the rules directory with inotify, editors usually
+// write a temp file and rename it, so the directory is watched instead of
+// the files themselves. onChange is called after the rules were reloaded
+// and actually changed.
+func watchRule(ctx context.Context, path string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := w.Add(path); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+
+		// coalesce the burst of events of a single save
+		debounce := time.NewTimer(time.Hour)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if !watchFiles[filepath.Base(ev.Name)] || ev.Op == fsnotify.Chmod {
+					continue
+				}
+
+				debounce.Reset(time.Millisecond * 500)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("watchRule", "err", err)
+
+			case <-debounce.C:
+				if reloadRule(path) {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// keepRules restores the merged rules when the test ends.
+func keepRules(t *testing.T) {
+	rulesMu.RLock()
+	feed, custom, merged, p := feedRule, customRule, ips, prefixes
+	rulesMu.RUnlock()
+
+	t.Cleanup(func() {
+		rulesMu.Lock()
+		defer rulesMu.Unlock()
+		feedRule, customRule, ips, prefixes = feed, custom, merged, p
+	})
+}
+
+func TestWatchRule(t *testing.T) {
+	keepRules(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	changed := make(chan struct{}, 1)
+	if err := watchRule(ctx, dir, func() { changed <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "custom.txt"), []byte("203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("custom.txt change not detected")
+	}
+
+	if !slices.Contains(currentRules(), "203.0.113.0/24") {
+		t.Fatal("custom rule not merged")
+	}
+}